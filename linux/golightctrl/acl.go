@@ -0,0 +1,114 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	ACLSourceButton     = "button"
+	ACLSourceMQTTPrefix = "mqtt:"
+	ACLDefaultClass     = "public"
+)
+
+// clients identify themselves by publishing below this prefix, e.g. action/GoLightCtrl/by/web/alice/olgatemp
+// the broker makes sure nobody else can (e.g. mosquitto: pattern write action/GoLightCtrl/by/%c/#)
+var topic_lightctrl_by_pre_ string = topic_lightctrl_pre_ + "by/"
+
+func LoadAccessControl(filename string) (*AccessControl, error) {
+	var config ACLConfig
+	if err := LoadJSONConfigFile(filename, &config); err != nil {
+		return nil, err
+	}
+	acl := &AccessControl{
+		classof:      make(map[string]string, len(actionname_map_)),
+		defaultclass: config.DefaultClass,
+		sources:      config.Sources,
+	}
+	if len(acl.defaultclass) == 0 {
+		acl.defaultclass = ACLDefaultClass
+	}
+	for class, names := range config.Classes {
+		for _, name := range names {
+			if _, inmap := actionname_map_[name]; !inmap {
+				LogMain_.Printf("LoadAccessControl: Warning: %s uses unknown name %s", filename, name)
+			}
+			if otherclass, inmap := acl.classof[name]; inmap && otherclass != class {
+				return nil, fmt.Errorf("%s is in class %s and %s", name, otherclass, class)
+			}
+			acl.classof[name] = class
+		}
+	}
+	for _, policy := range acl.sources {
+		if policy.Source != ACLSourceButton && !strings.HasPrefix(policy.Source, ACLSourceMQTTPrefix) {
+			return nil, fmt.Errorf("unknown Source %s", policy.Source)
+		}
+	}
+	return acl, nil
+}
+
+func (acl *AccessControl) ClassOf(name string) string {
+	if class, inmap := acl.classof[name]; inmap {
+		return class
+	}
+	return acl.defaultclass
+}
+
+// returns the policy with the longest Source matching source
+func (acl *AccessControl) policyFor(source string) *ACLSourcePolicy {
+	var best *ACLSourcePolicy
+	for idx := range acl.sources {
+		if strings.HasPrefix(source, acl.sources[idx].Source) && (best == nil || len(acl.sources[idx].Source) > len(best.Source)) {
+			best = &acl.sources[idx]
+		}
+	}
+	return best
+}
+
+// a meta name may only be switched if source may switch all names it contains
+func (acl *AccessControl) Allowed(source, name string) bool {
+	return acl.allowed(acl.policyFor(source), name, 0)
+}
+
+func (acl *AccessControl) allowed(policy *ACLSourcePolicy, name string, depth int) bool {
+	if policy == nil || depth > 10 {
+		return false
+	}
+	if !stringInSlice(acl.ClassOf(name), policy.Classes) {
+		return false
+	}
+	if meta, ismeta := actionname_map_[name].(ActionMeta); ismeta {
+		for _, metaname := range meta.metaaction {
+			if _, inmap := actionname_map_[metaname]; inmap && !acl.allowed(policy, metaname, depth+1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mqttACLSource(topic string) string {
+	return ACLSourceMQTTPrefix + topic
+}
+
+// logs and returns false if source may not switch aon.Name. Without GOLIGHTCTRL_ACL everything is allowed
+func checkAccess(source string, aon r3events.LightCtrlActionOnName) bool {
+	if ACL_ == nil || ACL_.Allowed(source, aon.Name) {
+		return true
+	}
+	LogMain_.Printf("ACL: denied %s %s (class %s) to %s", aon.Action, aon.Name, ACL_.ClassOf(aon.Name), source)
+	return false
+}
+
+// returns the name if topic is topic_lightctrl_pre_ followed by a name in actionname_map_
+func lightctrlNameFromTopic(topic string) (string, bool) {
+	if !strings.HasPrefix(topic, topic_lightctrl_pre_) {
+		return "", false
+	}
+	name := topic[len(topic_lightctrl_pre_):]
+	_, inmap := actionname_map_[name]
+	return name, inmap
+}
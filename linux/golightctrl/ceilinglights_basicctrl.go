@@ -1,16 +1,25 @@
 // (c) Bernhard Tittelbach, 2016
 package main
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
 
 const num_basicctrl_relays_ = 8
+const basicctrl_answer_timeout_ = 3 * time.Second
+
+//line that changes nothing but makes the box print its current state
+var basicctrl_querystate_line_ = SerialLine(append(bytes.Repeat([]byte{'-'}, num_basicctrl_relays_), '\r', '\n'))
 
 func NewBasicCtrl(rd, wr chan SerialLine) *BasicCtrlBox {
 	//create and init new struct
 	bcb := &BasicCtrlBox{
-		rd:    rd,
-		wr:    wr,
-		state: make([]bool, num_basicctrl_relays_),
+		rd:       rd,
+		wr:       wr,
+		state:    make([]bool, num_basicctrl_relays_),
+		answered: make(chan struct{}, 1),
 	}
 	//start thread that updates state from tty
 	go func() {
@@ -35,10 +44,15 @@ func NewBasicCtrl(rd, wr chan SerialLine) *BasicCtrlBox {
 			bcb.state_mutex.Lock()
 			bcb.state = newstate
 			bcb.state_mutex.Unlock()
+			//wake up ReadCeilingLightsStates if it is waiting
+			select {
+			case bcb.answered <- struct{}{}:
+			default:
+			}
 		}
 	}()
 	//query current state on startup
-	wr <- append(bytes.Repeat([]byte{'-'}, num_basicctrl_relays_), '\r', '\n')
+	wr <- basicctrl_querystate_line_
 	//return new struct
 	return bcb
 }
@@ -51,6 +65,28 @@ func (ceiling_lights *BasicCtrlBox) GetCeilingLightsStates() []bool {
 	return state
 }
 
+// asks the box for its state and waits for the answer
+// on timeout, the last known state is returned together with an error
+func (ceiling_lights *BasicCtrlBox) ReadCeilingLightsStates() ([]bool, error) {
+	//forget answers to earlier queries or commands
+	select {
+	case <-ceiling_lights.answered:
+	default:
+	}
+	timeout := time.After(basicctrl_answer_timeout_)
+	select {
+	case ceiling_lights.wr <- basicctrl_querystate_line_:
+	case <-timeout:
+		return ceiling_lights.GetCeilingLightsStates(), fmt.Errorf("BasicCtrl tty did not accept state query within %s", basicctrl_answer_timeout_)
+	}
+	select {
+	case <-ceiling_lights.answered:
+		return ceiling_lights.GetCeilingLightsStates(), nil
+	case <-timeout:
+		return ceiling_lights.GetCeilingLightsStates(), fmt.Errorf("BasicCtrl did not answer state query within %s", basicctrl_answer_timeout_)
+	}
+}
+
 func (ceiling_lights *BasicCtrlBox) SetCeilingLightsState(ceiling_light_number int, onoff bool) {
 	if ceiling_light_number < 0 || ceiling_light_number >= num_basicctrl_relays_ {
 		return
@@ -78,3 +114,8 @@ func (ceiling_lights *BasicCtrlBox) SetCeilingLightsStates(state []bool) {
 	}
 	ceiling_lights.wr <- SerialLine(append(bs, '\r', '\n'))
 }
+
+// closes the tty once everything queued is written
+func (ceiling_lights *BasicCtrlBox) Close() {
+	close(ceiling_lights.wr)
+}
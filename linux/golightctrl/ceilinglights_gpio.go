@@ -1,9 +1,27 @@
 // (c) Bernhard Tittelbach, 2016
 package main
 
-import bbhw "github.com/btittelbach/go-bbhw"
+import (
+	"fmt"
 
-func CeilinglightsGPIO_FakeGPIOinit() CeilingLightsSwitchGPIO {
+	bbhw "github.com/btittelbach/go-bbhw"
+)
+
+// polled tells if goPollCeilingLightsStates keeps our state current. If not, GetCeilingLightsStates reads the pins each time
+func newCeilingLightsSwitchGPIO(gpios []bbhw.GPIOControllablePin, polled bool) *CeilingLightsSwitchGPIO {
+	for _, gpio := range gpios {
+		gpio.SetActiveLow(true)
+	}
+	ceiling_lights := &CeilingLightsSwitchGPIO{
+		gpios:  gpios,
+		state:  make([]bool, len(gpios)),
+		polled: polled,
+	}
+	ceiling_lights.ReadCeilingLightsStates()
+	return ceiling_lights
+}
+
+func CeilinglightsGPIO_FakeGPIOinit(polled bool) *CeilingLightsSwitchGPIO {
 	LogMain_.Print("FAKE GPIO/PWM init start")
 	bbhw.FakeGPIODefaultLogTarget_ = LogGPIO_
 	gpios_ceiling_lights := []bbhw.GPIOControllablePin{
@@ -14,14 +32,11 @@ func CeilinglightsGPIO_FakeGPIOinit() CeilingLightsSwitchGPIO {
 		bbhw.NewFakeGPIO(18, bbhw.OUT),
 		bbhw.NewFakeGPIO(4, bbhw.OUT),
 	}
-	for _, gpio := range gpios_ceiling_lights {
-		gpio.SetActiveLow(true)
-	}
-	LogMain_.Print("FAKE GPIO init done")
-	return gpios_ceiling_lights
+	defer LogMain_.Print("FAKE GPIO init done")
+	return newCeilingLightsSwitchGPIO(gpios_ceiling_lights, polled)
 }
 
-func CeilinglightsGPIO_GPIOinit() CeilingLightsSwitchGPIO {
+func CeilinglightsGPIO_GPIOinit(polled bool) *CeilingLightsSwitchGPIO {
 	LogMain_.Print("GPIO/PWM init start")
 	gpios_ceiling_lights := []bbhw.GPIOControllablePin{
 		bbhw.NewSysfsGPIOOrPanic(23, bbhw.OUT),
@@ -31,30 +46,67 @@ func CeilinglightsGPIO_GPIOinit() CeilingLightsSwitchGPIO {
 		bbhw.NewSysfsGPIOOrPanic(18, bbhw.OUT),
 		bbhw.NewSysfsGPIOOrPanic(4, bbhw.OUT),
 	}
-	for _, gpio := range gpios_ceiling_lights {
-		gpio.SetActiveLow(true)
-	}
-	LogMain_.Print("GPIO init done")
-	return gpios_ceiling_lights
+	defer LogMain_.Print("GPIO init done")
+	return newCeilingLightsSwitchGPIO(gpios_ceiling_lights, polled)
 }
 
-func (ceiling_lights CeilingLightsSwitchGPIO) GetCeilingLightsStates() []bool {
-	rv := make([]bool, len(ceiling_lights))
-	for i, gpio := range ceiling_lights {
-		rv[i] = bbhw.GetStateOrPanic(gpio)
+// the state we read last, or that of the pins right now if nobody polls them
+func (ceiling_lights *CeilingLightsSwitchGPIO) GetCeilingLightsStates() []bool {
+	if !ceiling_lights.polled {
+		rv, _ := ceiling_lights.ReadCeilingLightsStates() //already logged, unreadable pins keep their last state
+		return rv
 	}
+	return ceiling_lights.cachedCeilingLightsStates()
+}
+
+func (ceiling_lights *CeilingLightsSwitchGPIO) cachedCeilingLightsStates() []bool {
+	rv := make([]bool, len(ceiling_lights.gpios))
+	ceiling_lights.state_mutex.RLock()
+	copy(rv, ceiling_lights.state)
+	ceiling_lights.state_mutex.RUnlock()
 	return rv
 }
 
-func (ceiling_lights CeilingLightsSwitchGPIO) SetCeilingLightsState(ceiling_light_number int, onoff bool) {
-	if ceiling_light_number < 0 || ceiling_light_number >= len(ceiling_lights) {
+// reads all gpios. Pins that can't be read keep their last known state and are reported in the returned error
+func (ceiling_lights *CeilingLightsSwitchGPIO) ReadCeilingLightsStates() ([]bool, error) {
+	var failed []int
+	ceiling_lights.state_mutex.Lock()
+	for i, gpio := range ceiling_lights.gpios {
+		if st, err := gpio.GetState(); err == nil {
+			ceiling_lights.state[i] = st
+		} else {
+			LogGPIO_.Printf("ReadCeilingLightsStates: gpio %d: %s", i, err)
+			failed = append(failed, i)
+		}
+	}
+	ceiling_lights.state_mutex.Unlock()
+	if len(failed) > 0 {
+		return ceiling_lights.cachedCeilingLightsStates(), fmt.Errorf("could not read state of ceiling lights %v", failed)
+	}
+	return ceiling_lights.cachedCeilingLightsStates(), nil
+}
+
+func (ceiling_lights *CeilingLightsSwitchGPIO) SetCeilingLightsState(ceiling_light_number int, onoff bool) {
+	if ceiling_light_number < 0 || ceiling_light_number >= len(ceiling_lights.gpios) {
 		return
 	}
-	ceiling_lights[ceiling_light_number].SetState(onoff)
+	if err := ceiling_lights.gpios[ceiling_light_number].SetState(onoff); err != nil {
+		LogGPIO_.Printf("SetCeilingLightsState(%d,%t): %s", ceiling_light_number, onoff, err)
+		return
+	}
+	ceiling_lights.state_mutex.Lock()
+	ceiling_lights.state[ceiling_light_number] = onoff
+	ceiling_lights.state_mutex.Unlock()
 }
 
-func (ceiling_lights CeilingLightsSwitchGPIO) SetCeilingLightsStates(states []bool) {
+func (ceiling_lights *CeilingLightsSwitchGPIO) SetCeilingLightsStates(states []bool) {
 	for i, state := range states {
 		ceiling_lights.SetCeilingLightsState(i, state)
 	}
 }
+
+func (ceiling_lights *CeilingLightsSwitchGPIO) Close() {
+	for _, gpio := range ceiling_lights.gpios {
+		gpio.Close()
+	}
+}
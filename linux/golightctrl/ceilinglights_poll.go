@@ -0,0 +1,113 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btittelbach/pubsub"
+)
+
+const (
+	DEFAULT_GOLIGHTCTRL_POLLINTERVAL string = "10s"
+	//after switching, give the hardware some time before we compare commanded and actual state
+	ceilinglights_drift_grace_ = 5 * time.Second
+)
+
+func NewCeilingLightsTracker(backend CeilingLightsSwitch) *CeilingLightsTracker {
+	return &CeilingLightsTracker{backend: backend}
+}
+
+func (tracker *CeilingLightsTracker) GetCeilingLightsStates() []bool {
+	return tracker.backend.GetCeilingLightsStates()
+}
+
+func (tracker *CeilingLightsTracker) ReadCeilingLightsStates() ([]bool, error) {
+	return tracker.backend.ReadCeilingLightsStates()
+}
+
+func (tracker *CeilingLightsTracker) Close() {
+	tracker.backend.Close()
+}
+
+func (tracker *CeilingLightsTracker) rememberCommand(ceiling_light_number int, onoff bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.last_command = time.Now()
+	if ceiling_light_number < 0 || ceiling_light_number >= len(tracker.commanded) {
+		return
+	}
+	tracker.commanded[ceiling_light_number] = onoff
+}
+
+func (tracker *CeilingLightsTracker) SetCeilingLightsState(ceiling_light_number int, onoff bool) {
+	tracker.rememberCommand(ceiling_light_number, onoff)
+	tracker.backend.SetCeilingLightsState(ceiling_light_number, onoff)
+}
+
+func (tracker *CeilingLightsTracker) SetCeilingLightsStates(states []bool) {
+	for i, state := range states {
+		tracker.rememberCommand(i, state)
+	}
+	tracker.backend.SetCeilingLightsStates(states)
+}
+
+// reads back the actual state and compares it to what we read last time and to what we last commanded
+// changes are published as PS_LIGHTS_CHANGED, differences to the commanded state as PS_LIGHTS_DRIFT
+func (tracker *CeilingLightsTracker) poll(ps *pubsub.PubSub) error {
+	actual, err := tracker.backend.ReadCeilingLightsStates()
+	if err != nil {
+		return err
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	changed := len(actual) != len(tracker.actual)
+	for i := 0; !changed && i < len(actual); i++ {
+		changed = actual[i] != tracker.actual[i]
+	}
+	tracker.actual = actual
+	if changed {
+		ps.PubNonBlocking(ConvertCeilingLightsStateTomap(actual, 1), PS_LIGHTS_CHANGED)
+	}
+	if len(tracker.commanded) != len(actual) {
+		//first successful read, nothing was commanded yet
+		tracker.commanded = make([]bool, len(actual))
+		copy(tracker.commanded, actual)
+		return nil
+	}
+	if time.Since(tracker.last_command) < ceilinglights_drift_grace_ {
+		return nil
+	}
+	for i := range actual {
+		if actual[i] == tracker.commanded[i] {
+			continue
+		}
+		drift := BasicLightDrift{Light: fmt.Sprintf("ceiling%d", i+1), Commanded: tracker.commanded[i], Actual: actual[i], Ts: time.Now().Unix()}
+		LogGPIO_.Printf("CeilingLightsTracker: drift detected: %+v", drift)
+		ps.PubNonBlocking(drift, PS_LIGHTS_DRIFT)
+		//somebody switched by hand, the physical state is the one we go with from now on
+		tracker.commanded[i] = actual[i]
+	}
+	return nil
+}
+
+func goPollCeilingLightsStates(ps *pubsub.PubSub, tracker *CeilingLightsTracker, interval time.Duration) {
+	shutdown_c := ps.SubOnce(PS_SHUTDOWN)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	num_failed_reads := 0
+	for {
+		select {
+		case <-shutdown_c:
+			return
+		case <-ticker.C:
+			if err := tracker.poll(ps); err != nil {
+				num_failed_reads++
+				LogGPIO_.Printf("goPollCeilingLightsStates: read %d failed: %s", num_failed_reads, err)
+			} else if num_failed_reads > 0 {
+				LogGPIO_.Printf("goPollCeilingLightsStates: reading works again after %d failed reads", num_failed_reads)
+				num_failed_reads = 0
+			}
+		}
+	}
+}
@@ -5,6 +5,8 @@ import "github.com/realraum/door_and_sensors/r3events"
 
 const (
 	PS_LIGHTS_CHANGED    = "light_state_changed"
+	PS_LIGHTS_DRIFT      = "light_state_drift"
+	PS_RF_SWITCHED       = "rf_outlet_switched"
 	PS_IRRF433_CHANGED   = "stateless_button_send_event"
 	PS_SHUTDOWN          = "shutdown"
 	PS_SHUTDOWN_CONSUMER = "shutdownindiscriminateconsumer"
@@ -14,10 +16,18 @@ var switch_name_chan_ chan r3events.LightCtrlActionOnName
 var MQTT_ir_chan_ chan string
 var MQTT_chan_ chan ActionMQTTMsg
 var RF433_linearize_chan_ chan RFCmdToSend
+var presence_event_chan_ chan interface{}
+var rule_msg_chan_ chan RuleMQTTMsg
+var scene_device_state_chan_ chan SceneDeviceState
+var scene_cmd_chan_ chan r3events.LightCtrlActionOnName
 
 func init() {
 	switch_name_chan_ = make(chan r3events.LightCtrlActionOnName, 50)
 	RF433_linearize_chan_ = make(chan RFCmdToSend, 10)
 	MQTT_ir_chan_ = make(chan string, 10)
 	MQTT_chan_ = make(chan ActionMQTTMsg, 10)
+	presence_event_chan_ = make(chan interface{}, 10)
+	rule_msg_chan_ = make(chan RuleMQTTMsg, 50)
+	scene_device_state_chan_ = make(chan SceneDeviceState, 50)
+	scene_cmd_chan_ = make(chan r3events.LightCtrlActionOnName, 10)
 }
@@ -0,0 +1,103 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	DEFAULT_GOLIGHTCTRL_HADISCOVERY string = "homeassistant"
+	ha_unique_id_prefix_                   = "golightctrl_"
+)
+
+var (
+	topic_lightctrl_online_ string = topic_lightctrl_state_pre_ + r3events.TYPE_ONLINEJSON
+	ha_discovery_prefix_    string
+	ha_discovery_owner_     = HADiscoveryOwner{Identifiers: []string{r3events.CLIENTID_LIGHTCTRL}, Name: r3events.CLIENTID_LIGHTCTRL, Manufacturer: "realraum"}
+)
+
+func onlinePayload(online bool) []byte {
+	return r3events.MarshalEvent2ByteOrPanic(r3events.Online{Online: online})
+}
+
+// Home Assistant component and config for name, or "" if HA can't do anything useful with it
+func haDiscoveryConfigFor(name string, action ActionNameHandler) (string, HADiscoveryConfig) {
+	config := HADiscoveryConfig{
+		Name:                 name,
+		UniqueId:             ha_unique_id_prefix_ + name,
+		CommandTopic:         topic_lightctrl_pre_ + name,
+		AvailabilityTopic:    topic_lightctrl_online_,
+		AvailabilityTemplate: "{{ 'online' if value_json.online else 'offline' }}",
+		PayloadAvailable:     "online",
+		PayloadNotAvailable:  "offline",
+		Device:               ha_discovery_owner_,
+	}
+	switch nm := action.(type) {
+	case ActionBasicLight:
+		config.StateTopic = basiclightstatetopic(nm.light)
+		config.ValueTemplate = "{{ 'on' if value_json.On else 'off' }}"
+		config.PayloadOn, config.PayloadOff = "on", "off"
+		config.StateOn, config.StateOff = "on", "off"
+		return "switch", config
+	case ActionRFCode:
+		//rf outlets don't tell us their state
+		config.PayloadOn, config.PayloadOff = "on", "off"
+		config.Optimistic = true
+		return "switch", config
+	case ActionIRCmdMQTT, ActionMQTTMsg:
+		config.PayloadPress = "send"
+		return "button", config
+	case ActionMeta:
+		config.PayloadOn = "on"
+		return "scene", config
+	}
+	return "", config
+}
+
+func haDiscoveryTopic(component, name string) string {
+	return ha_discovery_prefix_ + "/" + component + "/" + r3events.CLIENTID_LIGHTCTRL + "/" + name + "/config"
+}
+
+// publishes retained discovery configs for all of actionname_map_, so Home Assistant knows them without yaml
+func publishHADiscovery(mqttc mqtt.Client) {
+	if mqttc == nil || len(ha_discovery_prefix_) == 0 {
+		return
+	}
+	names := make([]string, 0, len(actionname_map_))
+	for name := range actionname_map_ {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		component, config := haDiscoveryConfigFor(name, actionname_map_[name])
+		if len(component) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			LogMQTT_.Printf("publishHADiscovery: %s: %s", name, err)
+			continue
+		}
+		mqttc.Publish(haDiscoveryTopic(component, name), MQTT_QOS_REQCONFIRMATION, true, payload)
+	}
+	LogMQTT_.Printf("publishHADiscovery: published %d names below %s", len(names), ha_discovery_prefix_)
+}
+
+// Home Assistant announces itself on <prefix>/status after restarting and may have lost our configs
+func subscribeHAStatus(mqttc mqtt.Client) {
+	if len(ha_discovery_prefix_) == 0 {
+		return
+	}
+	SubscribeAndAttachCallback(mqttc, ha_discovery_prefix_+"/status", func(c mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() || string(msg.Payload()) != "online" {
+			return
+		}
+		//give HA a moment to subscribe to its discovery topics
+		time.AfterFunc(2*time.Second, func() { publishHADiscovery(c) })
+	})
+}
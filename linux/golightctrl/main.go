@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -24,25 +25,33 @@ const (
 )
 
 var (
-	UseFakeGPIO_         bool
-	DebugFlags_          string
-	ps_                  *pubsub.PubSub
-	topic_lightctrl_pre_ string = r3events.TOPIC_ACTIONS + r3events.CLIENTID_LIGHTCTRL + "/"
-	CeilingLightsSwitch_ CeilingLightsSwitch
+	UseFakeGPIO_               bool
+	DebugFlags_                string
+	PresenceRules_             *PresenceRules
+	Rules_                     []Rule
+	ReplayRulesFile_           string
+	ACL_                       *AccessControl
+	ps_                        *pubsub.PubSub
+	topic_lightctrl_pre_       string = r3events.TOPIC_ACTIONS + r3events.CLIENTID_LIGHTCTRL + "/"
+	topic_lightctrl_state_pre_ string = r3events.TOPIC_R3 + r3events.CLIENTID_LIGHTCTRL + "/"
+	topic_lightctrl_drift_     string = topic_lightctrl_state_pre_ + "drift"
+	CeilingLightsSwitch_       CeilingLightsSwitch
 )
 
 func init() {
 	flag.BoolVar(&UseFakeGPIO_, "fakegpio", false, "For testing")
 	flag.StringVar(&DebugFlags_, "debug", "", "List of DebugFlags separated by ,")
+	flag.StringVar(&ReplayRulesFile_, "replayrules", "", "Feed recorded MQTT messages to rules from GOLIGHTCTRL_RULES, print what would happen and exit")
 	ps_ = pubsub.New(50)
 }
 
 //Connect and keep trying to connect to MQTT Broker
 //And while we cannot, still provide as much functionality as possible
-func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan chan SerialLine) {
+//What we start is stopped with the shutdown stages: input takes commands, output sends them on, connection is MQTT itself
+func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan chan SerialLine, input, output, connection *shutdownStage) {
 	//Start Channel Gobblers and Functionality that works without mqtt
 	//These shut down once we send PS_SHUTDOWN_CONSUMER
-	go goLinearizeRFSenders(ps_, RF433_linearize_chan_, tty_rf433_chan, nil)
+	output.Go(func(ctx context.Context) { goLinearizeRFSenders(ctx, ps_, RF433_linearize_chan_, tty_rf433_chan, nil) })
 	//consume MQTT_ledpattern_chan_ and MQTT_ir_chan_
 	go func() {
 		shutdown_c := ps_.SubOnce(PS_SHUTDOWN_CONSUMER)
@@ -74,7 +83,9 @@ func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan chan Se
 					return
 				}
 				LogMain_.Printf("Main:LightCtrlMain: %+v", aon)
-				switch_name_chan_ <- aon
+				if checkAccess(mqttACLSource(msg.Topic()), aon) {
+					switchNameUnlessDone(input.ctx, aon)
+				}
 			})
 			for name, _ := range actionname_map_ {
 				SubscribeAndAttachCallback(mqttc, topic_lightctrl_pre_+name, func(c mqtt.Client, msg mqtt.Message) {
@@ -82,33 +93,105 @@ func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan chan Se
 					if msg.Retained() {
 						return
 					}
+					if isButtonEcho(msg.Topic(), msg.Payload()) {
+						return //already switched when the button was pressed
+					}
 					aon.Name = msg.Topic()[len(topic_lightctrl_pre_):]
 					aon.Action = string(msg.Payload())
 					LogMain_.Printf("Main:LightCtrlMain: %+v", aon)
-					switch_name_chan_ <- aon
+					if checkAccess(mqttACLSource(msg.Topic()), aon) {
+						switchNameUnlessDone(input.ctx, aon)
+					}
 				})
 			}
+			subscribeHAStatus(mqttc)
+			if PresenceRules_ != nil {
+				subscribePresenceEvents(mqttc)
+			}
+			if len(Rules_) > 0 {
+				subscribeRuleTopics(mqttc, Rules_)
+			}
+			subscribeSceneTopics(mqttc)
+			SubscribeAndAttachCallback(mqttc, topic_lightctrl_by_pre_+"#", func(c mqtt.Client, msg mqtt.Message) {
+				var aon r3events.LightCtrlActionOnName
+				if msg.Retained() {
+					return
+				}
+				aon.Name = msg.Topic()[strings.LastIndex(msg.Topic(), "/")+1:]
+				aon.Action = string(msg.Payload())
+				LogMain_.Printf("Main:LightCtrlMain: %+v from %s", aon, msg.Topic())
+				if checkAccess(mqttACLSource(msg.Topic()), aon) {
+					switchNameUnlessDone(input.ctx, aon)
+				}
+			})
+			input.Go(func(ctx context.Context) {
+				<-ctx.Done()
+				UnsubscribeAll(mqttc)
+			})
+			connection.Go(func(ctx context.Context) {
+				<-ctx.Done()
+				DisconnectMQTT(mqttc)
+			})
 			ps_.Pub(true, PS_SHUTDOWN_CONSUMER) //shutdown all chan consumers for mqttc == nil
 			time.Sleep(5 * time.Second)         //avoid goLinearizeRFSender that we start below to shutdown right away
-			go goSendIRCmdToMQTT(mqttc, MQTT_ir_chan_)
-			go goSendMQTTMsg(mqttc, MQTT_chan_)
-			go goLinearizeRFSenders(ps_, RF433_linearize_chan_, tty_rf433_chan, mqttc)
+			output.Go(func(ctx context.Context) { goSendIRCmdToMQTT(ctx, mqttc, MQTT_ir_chan_) })
+			output.Go(func(ctx context.Context) { goSendMQTTMsg(ctx, mqttc, MQTT_chan_) })
+			output.Go(func(ctx context.Context) { goPublishLightStatesToMQTT(ctx, mqttc, ps_) })
+			output.Go(func(ctx context.Context) {
+				goManageScenes(ctx, ps_, EnvironOrDefault("GOLIGHTCTRL_SCENESFILE", DEFAULT_GOLIGHTCTRL_SCENESFILE), mqttc)
+			})
+			output.Go(func(ctx context.Context) {
+				goLinearizeRFSenders(ctx, ps_, RF433_linearize_chan_, tty_rf433_chan, mqttc)
+			})
 			return // no need to keep on trying, mqtt-auto-reconnect will do the rest now
 		} else {
-			time.Sleep(5 * time.Minute)
+			select {
+			case <-time.After(5 * time.Minute):
+			case <-input.ctx.Done():
+				return
+			}
 		}
 	}
 }
 
 func main() {
 	flag.Parse()
+	ha_discovery_prefix_ = EnvironOrDefault("GOLIGHTCTRL_HADISCOVERY", DEFAULT_GOLIGHTCTRL_HADISCOVERY)
+	if ha_discovery_prefix_ == "off" {
+		ha_discovery_prefix_ = ""
+	}
 	if len(DebugFlags_) > 0 {
 		LogEnable(strings.Split(DebugFlags_, ",")...)
 	}
 
 	var err error
-	var tty_button_chan chan SerialLine
+	if acl_file := EnvironOrDefault("GOLIGHTCTRL_ACL", ""); len(acl_file) > 0 {
+		if ACL_, err = LoadAccessControl(acl_file); err != nil {
+			panic(fmt.Sprintf("can't load GOLIGHTCTRL_ACL %s: %s", acl_file, err))
+		}
+	}
+	if rules_file := EnvironOrDefault("GOLIGHTCTRL_RULES", ""); len(rules_file) > 0 {
+		if Rules_, err = LoadRules(rules_file); err != nil {
+			LogMain_.Printf("can't load GOLIGHTCTRL_RULES %s: %s", rules_file, err)
+		}
+	}
+	if len(ReplayRulesFile_) > 0 {
+		if err = ReplayRules(Rules_, ReplayRulesFile_, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	poll_interval, err := time.ParseDuration(EnvironOrDefault("GOLIGHTCTRL_POLLINTERVAL", DEFAULT_GOLIGHTCTRL_POLLINTERVAL))
+	if err != nil {
+		LogMain_.Println("can't parse GOLIGHTCTRL_POLLINTERVAL:", err)
+		poll_interval = 0
+	}
+
+	var tty_button_chan, tty_button_write_chan chan SerialLine
 	var tty_rf433_chan chan SerialLine
+	var ceiling_lights_backend CeilingLightsSwitch
 	if UseFakeGPIO_ {
 		tty_rf433_chan = make(chan SerialLine, 10)
 		go func() {
@@ -117,14 +200,15 @@ func main() {
 			}
 		}()
 		tty_button_chan = make(chan SerialLine, 1)
-		CeilingLightsSwitch_ = CeilinglightsGPIO_FakeGPIOinit()
+		tty_button_write_chan = make(chan SerialLine)
+		ceiling_lights_backend = CeilinglightsGPIO_FakeGPIOinit(poll_interval > 0)
 	} else {
 		tty_rf433_chan, _, err = OpenAndHandleSerial(EnvironOrDefault("GOLIGHTCTRL_RF433TTYDEV", DEFAULT_GOLIGHTCTRL_RF433TTYDEV), 9600)
 		if err != nil {
 			panic("can't open GOLIGHTCTRL_RF433TTYDEV")
 		}
 
-		_, tty_button_chan, err = OpenAndHandleSerial(EnvironOrDefault("GOLIGHTCTRL_BUTTONTTYDEV", DEFAULT_GOLIGHTCTRL_BUTTONTTYDEV), 9600)
+		tty_button_write_chan, tty_button_chan, err = OpenAndHandleSerial(EnvironOrDefault("GOLIGHTCTRL_BUTTONTTYDEV", DEFAULT_GOLIGHTCTRL_BUTTONTTYDEV), 9600)
 		if err != nil {
 			panic("can't open GOLIGHTCTRL_BUTTONTTYDEV")
 		}
@@ -133,17 +217,39 @@ func main() {
 		if err != nil {
 			LogMain_.Println("can't open GOLIGHTCTRL_BASICCTRLTTYDEV")
 			LogMain_.Println("switching CeilingLights via RPi GPIO")
-			CeilingLightsSwitch_ = CeilinglightsGPIO_GPIOinit()
+			ceiling_lights_backend = CeilinglightsGPIO_GPIOinit(poll_interval > 0)
 		} else {
 			LogMain_.Println("switching CeilingLights via BasicCtrl tty")
-			CeilingLightsSwitch_ = NewBasicCtrl(tty_basicctrl_read_chan, tty_basicctrl_write_chan)
+			ceiling_lights_backend = NewBasicCtrl(tty_basicctrl_read_chan, tty_basicctrl_write_chan)
 		}
 
 	}
+	input := newShutdownStage("input")
+	output := newShutdownStage("output")
+	connection := newShutdownStage("mqtt connection")
 
-	go GoSwitchNameAsync()
-	go goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan)
-	go goListenForButtons(tty_button_chan)
+	ceiling_lights_tracker := NewCeilingLightsTracker(ceiling_lights_backend)
+	CeilingLightsSwitch_ = ceiling_lights_tracker
+
+	if poll_interval > 0 {
+		go goPollCeilingLightsStates(ps_, ceiling_lights_tracker, poll_interval)
+	}
+
+	if presence_rules_file := EnvironOrDefault("GOLIGHTCTRL_PRESENCERULES", ""); len(presence_rules_file) > 0 {
+		if PresenceRules_, err = LoadPresenceRules(presence_rules_file); err != nil {
+			LogMain_.Printf("can't load GOLIGHTCTRL_PRESENCERULES %s: %s", presence_rules_file, err)
+		} else {
+			input.Go(func(ctx context.Context) { goPresenceAutomation(ctx, PresenceRules_, presence_event_chan_, newPresenceTimer) })
+		}
+	}
+
+	if len(Rules_) > 0 {
+		input.Go(func(ctx context.Context) { goRunRules(ctx, Rules_, rule_msg_chan_) })
+	}
+
+	input.Go(GoSwitchNameAsync)
+	go goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(tty_rf433_chan, input, output, connection)
+	input.Go(func(ctx context.Context) { goListenForButtons(ctx, tty_button_chan) })
 
 	// wait on Ctrl-C or sigInt or sigKill
 	func() {
@@ -153,4 +259,17 @@ func main() {
 		fmt.Println("SIGINT received, exiting gracefully ...")
 	}()
 
+	//automation stops first, then we stop taking commands, send on what is queued, say goodbye to the broker and release the hardware
+	deadline, cancel := context.WithTimeout(context.Background(), shutdown_timeout_)
+	defer cancel()
+	ps_.Pub(true, PS_SHUTDOWN)
+	inputdone := input.Stop(deadline)
+	outputdone := output.Stop(deadline)
+	connection.Stop(deadline)
+	if inputdone && outputdone {
+		//nobody switches or writes to the ttys anymore
+		close(tty_rf433_chan)
+		close(tty_button_write_chan)
+		CeilingLightsSwitch_.Close()
+	}
 }
@@ -2,9 +2,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/btittelbach/pubsub"
 	"github.com/realraum/door_and_sensors/r3events"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -46,6 +50,9 @@ func mqttOnConnectionHandler(mqttc mqtt.Client) {
 		return
 	}
 	LogMQTT_.Print("MQTT connection to broker established. (re)subscribing topics")
+	//our will says offline, so say we are back
+	mqttc.Publish(topic_lightctrl_online_, MQTT_QOS_REQCONFIRMATION, true, onlinePayload(true))
+	publishHADiscovery(mqttc)
 	mqtt_topics_we_subscribed_lock_.RLock()
 	defer mqtt_topics_we_subscribed_lock_.RUnlock()
 	if len(mqtt_topics_we_subscribed_) > 0 {
@@ -60,7 +67,7 @@ func mqttOnConnectionHandler(mqttc mqtt.Client) {
 func ConnectMQTTBroker(brocker_addr, clientid string) mqtt.Client {
 	options := mqtt.NewClientOptions().AddBroker(brocker_addr).SetAutoReconnect(true).SetKeepAlive(30 * time.Second).SetMaxReconnectInterval(2 * time.Minute)
 	options = options.SetClientID(clientid).SetConnectionLostHandler(func(c mqtt.Client, err error) { LogMQTT_.Print("ERROR MQTT connection lost:", err) })
-	options = options.SetOnConnectHandler(mqttOnConnectionHandler)
+	options = options.SetOnConnectHandler(mqttOnConnectionHandler).SetBinaryWill(topic_lightctrl_online_, onlinePayload(false), MQTT_QOS_REQCONFIRMATION, true)
 	c := mqtt.NewClient(options)
 	tk := c.Connect()
 	tk.Wait()
@@ -71,12 +78,25 @@ func ConnectMQTTBroker(brocker_addr, clientid string) mqtt.Client {
 	return c
 }
 
-func goSendMQTTMsg(mqttc mqtt.Client, mqtt_msg_chan chan ActionMQTTMsg) {
+// once ctx is done, sends what is still queued and returns
+func goSendMQTTMsg(ctx context.Context, mqttc mqtt.Client, mqtt_msg_chan chan ActionMQTTMsg) {
 	if mqttc == nil {
 		return
 	}
-	for msg := range mqtt_msg_chan {
-		mqttc.Publish(msg.topic, MQTT_QOS_REQCONFIRMATION, false, msg.payload)
+	for {
+		select {
+		case msg := <-mqtt_msg_chan:
+			mqttc.Publish(msg.topic, MQTT_QOS_REQCONFIRMATION, false, msg.payload)
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-mqtt_msg_chan:
+					mqttc.Publish(msg.topic, MQTT_QOS_REQCONFIRMATION, false, msg.payload)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
 
@@ -92,15 +112,84 @@ func sendCodeToMQTT(mqttc mqtt.Client, code []byte) {
 	}
 }
 
-func goSendIRCmdToMQTT(mqttc mqtt.Client, ir_chan chan string) {
+// once ctx is done, sends what is still queued and returns
+func goSendIRCmdToMQTT(ctx context.Context, mqttc mqtt.Client, ir_chan chan string) {
 	if mqttc == nil {
 		return
 	}
-	for cmd := range ir_chan {
+	send := func(cmd string) {
 		r3evt := r3events.YamahaIRCmd{Cmd: cmd, Ts: time.Now().Unix()}
 		LogMQTT_.Printf("goSendIRCmdToMQTT: %+v", r3evt)
 		mqttc.Publish(r3events.ACT_YAMAHA_SEND, MQTT_QOS_REQCONFIRMATION, false, r3events.MarshalEvent2ByteOrPanic(r3evt))
 	}
+	for {
+		select {
+		case cmd := <-ir_chan:
+			send(cmd)
+		case <-ctx.Done():
+			for {
+				select {
+				case cmd := <-ir_chan:
+					send(cmd)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// payloads given as json string are sent without quotes, e.g. "off" for sonoffs
+func (msg JsonMQTTMsg) ToActionMQTTMsg() ActionMQTTMsg {
+	var strpayload string
+	if err := json.Unmarshal(msg.Payload, &strpayload); err == nil {
+		return ActionMQTTMsg{msg.Topic, []byte(strpayload)}
+	}
+	return ActionMQTTMsg{msg.Topic, []byte(msg.Payload)}
+}
+
+func basiclightstatetopic(light int) string {
+	return topic_lightctrl_state_pre_ + fmt.Sprintf("basiclight%d", light+1)
+}
+
+// publishes changes of the ceiling light states (retained) and detected drift, until ctx is done
+func goPublishLightStatesToMQTT(ctx context.Context, mqttc mqtt.Client, ps *pubsub.PubSub) {
+	if mqttc == nil {
+		return
+	}
+	lights_c := ps.Sub(PS_LIGHTS_CHANGED, PS_LIGHTS_DRIFT)
+	defer ps.Unsub(lights_c)
+	last_published := make(CeilingLightStateMap, num_basicctrl_relays_)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt, isopen := <-lights_c:
+			if !isopen {
+				//PubNonBlocking unsubscribed us because we were too slow
+				LogMQTT_.Print("goPublishLightStatesToMQTT: missed light state updates, resubscribing")
+				lights_c = ps.Sub(PS_LIGHTS_CHANGED, PS_LIGHTS_DRIFT)
+				last_published = make(CeilingLightStateMap, num_basicctrl_relays_)
+				continue
+			}
+			switch e := evt.(type) {
+			case CeilingLightStateMap:
+				for name, onoff := range e {
+					nm, isbasiclight := actionname_map_[name].(ActionBasicLight)
+					if !isbasiclight {
+						continue
+					}
+					if last, known := last_published[name]; known && last == onoff {
+						continue
+					}
+					last_published[name] = onoff
+					mqttc.Publish(basiclightstatetopic(nm.light), MQTT_QOS_REQCONFIRMATION, true, r3events.MarshalEvent2ByteOrPanic(BasicLightState{On: onoff, Ts: time.Now().Unix()}))
+				}
+			case BasicLightDrift:
+				mqttc.Publish(topic_lightctrl_drift_, MQTT_QOS_REQCONFIRMATION, false, r3events.MarshalEvent2ByteOrPanic(e))
+			}
+		}
+	}
 }
 
 func SubscribeAndAttachCallback(mqttc mqtt.Client, filter string, callback mqtt.MessageHandler) {
@@ -148,6 +237,29 @@ func SubscribeMultipleAndForwardToChannel(mqttc mqtt.Client, filters []string) (
 	return
 }
 
+// so no more commands come in while we shut down
+func UnsubscribeAll(mqttc mqtt.Client) {
+	mqtt_topics_we_subscribed_lock_.RLock()
+	topics := make([]string, 0, len(mqtt_topics_we_subscribed_))
+	for topic := range mqtt_topics_we_subscribed_ {
+		topics = append(topics, topic)
+	}
+	mqtt_topics_we_subscribed_lock_.RUnlock()
+	if len(topics) == 0 {
+		return
+	}
+	mqttc.Unsubscribe(topics...).WaitTimeout(time.Second)
+	for _, topic := range topics {
+		removeSubscribedTopic(topic)
+	}
+}
+
+// a clean disconnect doesn't trigger our will, so we say we are offline ourselves
+func DisconnectMQTT(mqttc mqtt.Client) {
+	mqttc.Publish(topic_lightctrl_online_, MQTT_QOS_REQCONFIRMATION, true, onlinePayload(false)).WaitTimeout(time.Second)
+	mqttc.Disconnect(mqtt_disconnect_quiesce_ms_)
+}
+
 func UnsubscribeMultiple(mqttc mqtt.Client, topics ...string) {
 	mqttc.Unsubscribe(topics...)
 	for _, topic := range topics {
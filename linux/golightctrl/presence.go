@@ -0,0 +1,116 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+func LoadPresenceRules(filename string) (*PresenceRules, error) {
+	rules := &PresenceRules{}
+	if err := LoadJSONConfigFile(filename, rules); err != nil {
+		return nil, err
+	}
+	if rules.EmptyWarnBefore.Duration > rules.EmptyGracePeriod.Duration {
+		rules.EmptyWarnBefore.Duration = rules.EmptyGracePeriod.Duration
+	}
+	for _, aon := range append(rules.EmptyActions, rules.ArriveAfterDarkActions...) {
+		if _, inmap := actionname_map_[aon.Name]; !inmap {
+			LogMain_.Printf("LoadPresenceRules: Warning: %s uses unknown name %s", filename, aon.Name)
+		}
+	}
+	return rules, nil
+}
+
+func subscribePresenceEvents(mqttc mqtt.Client) {
+	forward := func(c mqtt.Client, msg mqtt.Message) {
+		evt, err := r3events.UnmarshalTopicByte2Event(msg.Topic(), msg.Payload())
+		if err != nil {
+			LogMain_.Printf("subscribePresenceEvents: %s: %s", msg.Topic(), err)
+			return
+		}
+		select {
+		case presence_event_chan_ <- evt:
+		default:
+			LogMain_.Printf("subscribePresenceEvents: dropping %+v", evt)
+		}
+	}
+	SubscribeAndAttachCallback(mqttc, r3events.TOPIC_META_PRESENCE, forward)
+	SubscribeAndAttachCallback(mqttc, r3events.TOPIC_META_DUSKORDAWN, forward)
+}
+
+func runActionList(ctx context.Context, what string, actions []r3events.LightCtrlActionOnName) {
+	for _, aon := range actions {
+		LogMain_.Printf("Presence: %s: %+v", what, aon)
+		if !switchNameUnlessDone(ctx, aon) {
+			return
+		}
+	}
+}
+
+func newPresenceTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// Switches things off after the space has been empty for a while (warning people first)
+// and welcomes people arriving after dark. newtimer is newPresenceTimer, unless testing
+func goPresenceAutomation(ctx context.Context, rules *PresenceRules, events <-chan interface{}, newtimer presenceTimerFunc) {
+	presence_known := false
+	present := false
+	have_sunlight := true //until told otherwise, don't switch on anything
+	var stopwarn, stopempty func() bool
+	var warn_c, empty_c <-chan time.Time
+	stopTimers := func() {
+		if stopwarn != nil {
+			stopwarn()
+		}
+		if stopempty != nil {
+			stopempty()
+		}
+		warn_c, empty_c = nil, nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			stopTimers()
+			return
+		case evt := <-events:
+			switch e := evt.(type) {
+			case r3events.DuskOrDawn:
+				have_sunlight = e.HaveSunlight
+			case r3events.PresenceUpdate:
+				was_known, was_present := presence_known, present
+				presence_known, present = true, e.Present
+				if !was_known || was_present == present {
+					continue
+				}
+				stopTimers()
+				if present {
+					LogMain_.Printf("Presence: somebody arrived, have_sunlight: %t", have_sunlight)
+					if !have_sunlight {
+						runActionList(ctx, "arrive after dark", rules.ArriveAfterDarkActions)
+					}
+				} else {
+					LogMain_.Printf("Presence: space is empty, running EmptyActions in %s", rules.EmptyGracePeriod)
+					if len(rules.EmptyWarn) > 0 {
+						warn_c, stopwarn = newtimer(rules.EmptyGracePeriod.Duration - rules.EmptyWarnBefore.Duration)
+					}
+					empty_c, stopempty = newtimer(rules.EmptyGracePeriod.Duration)
+				}
+			}
+		case <-warn_c:
+			warn_c = nil
+			for _, msg := range rules.EmptyWarn {
+				LogMain_.Printf("Presence: warning %s: %s", msg.Topic, msg.Payload)
+				sendMQTTUnlessDone(ctx, msg.ToActionMQTTMsg())
+			}
+		case <-empty_c:
+			empty_c = nil
+			runActionList(ctx, "space empty", rules.EmptyActions)
+		}
+	}
+}
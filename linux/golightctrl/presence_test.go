@@ -0,0 +1,137 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+func drainSwitchedNames() []string {
+	var names []string
+	for {
+		select {
+		case aon := <-switch_name_chan_:
+			names = append(names, aon.Name+":"+aon.Action)
+		default:
+			return names
+		}
+	}
+}
+
+func drainMQTTTopics() []string {
+	var topics []string
+	for {
+		select {
+		case msg := <-MQTT_chan_:
+			topics = append(topics, msg.topic)
+		default:
+			return topics
+		}
+	}
+}
+
+type fakePresenceTimer struct {
+	c       chan time.Time
+	stopped bool // or fired
+}
+
+// timers the test fires itself, the last one started per duration
+type fakePresenceTimers struct {
+	timers map[time.Duration]*fakePresenceTimer
+	mutex  sync.Mutex
+}
+
+func (ft *fakePresenceTimers) newTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	timer := &fakePresenceTimer{c: make(chan time.Time)}
+	ft.timers[d] = timer
+	return timer.c, func() bool {
+		ft.mutex.Lock()
+		defer ft.mutex.Unlock()
+		wasrunning := !timer.stopped
+		timer.stopped = true
+		return wasrunning
+	}
+}
+
+// fires the timer of duration d, unless it was never started or stopped since
+func (ft *fakePresenceTimers) fire(d time.Duration) {
+	ft.mutex.Lock()
+	timer, inmap := ft.timers[d]
+	running := inmap && !timer.stopped
+	if running {
+		timer.stopped = true
+	}
+	ft.mutex.Unlock()
+	if running {
+		timer.c <- time.Now()
+	}
+}
+
+type presenceTestSync struct{} //ignored, once it was taken the event before it is done
+
+func TestPresenceAutomation(t *testing.T) {
+	const warn, empty = 50 * time.Minute, time.Hour
+	rules := &PresenceRules{
+		EmptyGracePeriod:       JsonDuration{empty},
+		EmptyWarnBefore:        JsonDuration{empty - warn},
+		EmptyWarn:              []JsonMQTTMsg{{Topic: "action/ceiling/flash", Payload: json.RawMessage(`{}`)}},
+		EmptyActions:           []r3events.LightCtrlActionOnName{{Name: "basiclight1", Action: "off"}},
+		ArriveAfterDarkActions: []r3events.LightCtrlActionOnName{{Name: "couchred", Action: "on"}},
+	}
+	type step struct {
+		evt  interface{}   // nil to fire a timer instead
+		fire time.Duration // of the timer to fire
+	}
+	present := step{evt: r3events.PresenceUpdate{Present: true}}
+	absent := step{evt: r3events.PresenceUpdate{Present: false}}
+	tests := []struct {
+		name     string
+		steps    []step
+		switched []string
+		warned   []string
+	}{
+		{"first update only tells us the state", []step{absent, {fire: warn}, {fire: empty}}, nil, nil},
+		{"space becomes empty", []step{present, absent, {fire: warn}, {fire: empty}}, []string{"basiclight1:off"}, []string{"action/ceiling/flash"}},
+		{"somebody comes back before the warning", []step{present, absent, present, {fire: warn}, {fire: empty}}, nil, nil},
+		{"somebody comes back after the warning", []step{present, absent, {fire: warn}, present, {fire: empty}}, nil, []string{"action/ceiling/flash"}},
+		{"arriving by day", []step{absent, present}, nil, nil},
+		{"arriving after dark", []step{{evt: r3events.DuskOrDawn{HaveSunlight: false}}, absent, present}, []string{"couchred:on"}, nil},
+		{"repeated presence changes nothing", []step{{evt: r3events.DuskOrDawn{HaveSunlight: false}}, present, present}, nil, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			timers := &fakePresenceTimers{timers: make(map[time.Duration]*fakePresenceTimer)}
+			ctx, cancel := context.WithCancel(context.Background())
+			events := make(chan interface{})
+			done := make(chan struct{})
+			go func() {
+				goPresenceAutomation(ctx, rules, events, timers.newTimer)
+				close(done)
+			}()
+			for _, st := range tc.steps {
+				if st.evt != nil {
+					events <- st.evt
+				} else {
+					timers.fire(st.fire)
+				}
+				events <- presenceTestSync{}
+			}
+			cancel()
+			<-done
+			if switched := drainSwitchedNames(); !reflect.DeepEqual(switched, tc.switched) {
+				t.Errorf("switched %v, want %v", switched, tc.switched)
+			}
+			if warned := drainMQTTTopics(); !reflect.DeepEqual(warned, tc.warned) {
+				t.Errorf("warned on %v, want %v", warned, tc.warned)
+			}
+		})
+	}
+}
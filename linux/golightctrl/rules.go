@@ -0,0 +1,355 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func LoadRules(filename string) ([]Rule, error) {
+	var rules []Rule
+	if err := LoadJSONConfigFile(filename, &rules); err != nil {
+		return nil, err
+	}
+	for idx, rule := range rules {
+		if len(rule.Name) == 0 {
+			rules[idx].Name = fmt.Sprintf("rule%d", idx)
+		}
+		if err := checkRule(&rules[idx]); err != nil {
+			return nil, fmt.Errorf("%s: %s", rules[idx].Name, err)
+		}
+	}
+	if err := checkRuleLoops(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// topics a rule publishes on when it fires, directly or through the names in Actions
+func (rule *Rule) publishesOn() []string {
+	topics := make([]string, 0, len(rule.Publish)+len(rule.Actions))
+	for _, msg := range rule.Publish {
+		topics = append(topics, msg.Topic)
+	}
+	for _, aon := range rule.Actions {
+		if nm, ismqtt := actionname_map_[aon.Name].(ActionMQTTMsg); ismqtt {
+			topics = append(topics, nm.topic)
+		}
+	}
+	return topics
+}
+
+// a rule publishing on a topic rules listen to could fire itself or others forever
+func checkRuleLoops(rules []Rule) error {
+	for idx := range rules {
+		for _, topic := range rules[idx].publishesOn() {
+			for _, other := range rules {
+				if mqttTopicMatchesFilter(other.Topic, topic) {
+					return fmt.Errorf("%s: publishes on %s, which %s listens to", rules[idx].Name, topic, other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkRule(rule *Rule) error {
+	if len(rule.Topic) == 0 {
+		return fmt.Errorf("no Topic")
+	}
+	if len(rule.Actions) == 0 && len(rule.Publish) == 0 {
+		return fmt.Errorf("neither Actions nor Publish")
+	}
+	for _, hhmm := range []string{rule.After, rule.Before} {
+		if _, err := parseHHMM(hhmm); len(hhmm) > 0 && err != nil {
+			return err
+		}
+	}
+	for _, cond := range rule.Conditions {
+		switch cond.Op {
+		case "", "==", "!=", "<", "<=", ">", ">=", "exists", "!exists":
+		default:
+			return fmt.Errorf("unknown condition Op %s", cond.Op)
+		}
+	}
+	for _, name := range append(rule.LightsOn, rule.LightsOff...) {
+		if _, isbasiclight := actionname_map_[name].(ActionBasicLight); !isbasiclight {
+			return fmt.Errorf("%s is not a basic light", name)
+		}
+	}
+	for _, aon := range rule.Actions {
+		if _, inmap := actionname_map_[aon.Name]; !inmap {
+			return fmt.Errorf("unknown action name %s", aon.Name)
+		}
+	}
+	return nil
+}
+
+// returns minutes since midnight
+func parseHHMM(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func mqttTopicMatchesFilter(filter, topic string) bool {
+	filterparts := strings.Split(filter, "/")
+	topicparts := strings.Split(topic, "/")
+	for idx, fp := range filterparts {
+		if fp == "#" {
+			return true
+		}
+		if idx >= len(topicparts) {
+			return false
+		}
+		if fp != "+" && fp != topicparts[idx] {
+			return false
+		}
+	}
+	return len(filterparts) == len(topicparts)
+}
+
+// follows a dot separated path through decoded json. Numbers index arrays
+func jsonPathLookup(data interface{}, path string) (interface{}, bool) {
+	if len(path) == 0 {
+		return data, true
+	}
+	for _, elem := range strings.Split(path, ".") {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			var inmap bool
+			if data, inmap = d[elem]; !inmap {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(elem)
+			if err != nil || idx < 0 || idx >= len(d) {
+				return nil, false
+			}
+			data = d[idx]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func compareJSONValues(op string, a, b interface{}) bool {
+	if af, aisnum := a.(float64); aisnum {
+		if bf, bisnum := b.(float64); bisnum {
+			switch op {
+			case "", "==":
+				return af == bf
+			case "!=":
+				return af != bf
+			case "<":
+				return af < bf
+			case "<=":
+				return af <= bf
+			case ">":
+				return af > bf
+			case ">=":
+				return af >= bf
+			}
+			return false
+		}
+	}
+	if as, aisstr := a.(string); aisstr {
+		if bs, bisstr := b.(string); bisstr {
+			switch op {
+			case "", "==":
+				return as == bs
+			case "!=":
+				return as != bs
+			case "<":
+				return as < bs
+			case "<=":
+				return as <= bs
+			case ">":
+				return as > bs
+			case ">=":
+				return as >= bs
+			}
+			return false
+		}
+	}
+	switch op {
+	case "", "==":
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	case "!=":
+		return fmt.Sprint(a) != fmt.Sprint(b)
+	}
+	return false
+}
+
+func (cond RuleCondition) matches(data interface{}) bool {
+	value, found := jsonPathLookup(data, cond.Path)
+	switch cond.Op {
+	case "exists":
+		return found
+	case "!exists":
+		return !found
+	}
+	return found && compareJSONValues(cond.Op, value, cond.Value)
+}
+
+func (rule *Rule) matchesTime(ts time.Time) bool {
+	if len(rule.After) == 0 && len(rule.Before) == 0 {
+		return true
+	}
+	now := ts.Hour()*60 + ts.Minute()
+	after, before := 0, 24*60
+	if len(rule.After) > 0 {
+		after, _ = parseHHMM(rule.After)
+	}
+	if len(rule.Before) > 0 {
+		before, _ = parseHHMM(rule.Before)
+	}
+	if after <= before {
+		return now >= after && now < before
+	}
+	return now >= after || now < before //window wraps around midnight
+}
+
+func basicLightIsOn(states []bool, name string) bool {
+	nm, isbasiclight := actionname_map_[name].(ActionBasicLight)
+	return isbasiclight && nm.light < len(states) && states[nm.light]
+}
+
+// tells if rule wants to act on msg, given the current state of the basic lights
+func (rule *Rule) Matches(msg RuleMQTTMsg, lightstates []bool) bool {
+	if !mqttTopicMatchesFilter(rule.Topic, msg.topic) || !rule.matchesTime(msg.ts) {
+		return false
+	}
+	for _, name := range rule.LightsOn {
+		if !basicLightIsOn(lightstates, name) {
+			return false
+		}
+	}
+	for _, name := range rule.LightsOff {
+		if basicLightIsOn(lightstates, name) {
+			return false
+		}
+	}
+	var data interface{}
+	if err := json.Unmarshal(msg.payload, &data); err != nil {
+		data = string(msg.payload) //not json, compare as string
+	}
+	for _, cond := range rule.Conditions {
+		if !cond.matches(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// switches and publishes what the rule says, unless ctx is done first
+func (rule *Rule) Execute(ctx context.Context) {
+	LogMain_.Printf("Rule %s fired", rule.Name)
+	for _, aon := range rule.Actions {
+		if !switchNameUnlessDone(ctx, aon) {
+			return
+		}
+	}
+	for _, msg := range rule.Publish {
+		if !sendMQTTUnlessDone(ctx, msg.ToActionMQTTMsg()) {
+			return
+		}
+	}
+}
+
+// subscribes every topic filter used in rules once
+func subscribeRuleTopics(mqttc mqtt.Client, rules []Rule) {
+	subscribed := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if subscribed[rule.Topic] {
+			continue
+		}
+		subscribed[rule.Topic] = true
+		filter := rule.Topic
+		SubscribeAndAttachCallback(mqttc, filter, func(c mqtt.Client, msg mqtt.Message) {
+			if msg.Retained() {
+				return
+			}
+			select {
+			case rule_msg_chan_ <- RuleMQTTMsg{filter: filter, topic: msg.Topic(), payload: msg.Payload(), ts: time.Now()}:
+			default:
+				LogMain_.Printf("subscribeRuleTopics: dropping message on %s", msg.Topic())
+			}
+		})
+	}
+}
+
+func goRunRules(ctx context.Context, rules []Rule, msg_chan <-chan RuleMQTTMsg) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-msg_chan:
+			lightstates := CeilingLightsSwitch_.GetCeilingLightsStates()
+			for idx := range rules {
+				//a message matching several filters is delivered once per filter
+				if rules[idx].Topic == msg.filter && rules[idx].Matches(msg, lightstates) {
+					rules[idx].Execute(ctx)
+				}
+			}
+		}
+	}
+}
+
+// Reads recorded messages and prints to out which rules would fire. Nothing is switched.
+// Basic light states start out off and follow the actions of fired rules.
+func ReplayRules(rules []Rule, recordfile string, out io.Writer) error {
+	fh, err := os.Open(recordfile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	lightstates := make([]bool, num_basicctrl_relays_)
+	linescanner := bufio.NewScanner(fh)
+	for lineno := 1; linescanner.Scan(); lineno++ {
+		if len(strings.TrimSpace(linescanner.Text())) == 0 {
+			continue
+		}
+		var rec RecordedMQTTMsg
+		if err := json.Unmarshal(linescanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %s", recordfile, lineno, err)
+		}
+		msg := RuleMQTTMsg{topic: rec.Topic, payload: []byte(rec.Payload), ts: time.Unix(rec.Ts, 0)}
+		if rec.Ts == 0 {
+			msg.ts = time.Now()
+		}
+		var strpayload string
+		if json.Unmarshal(rec.Payload, &strpayload) == nil {
+			msg.payload = []byte(strpayload)
+		}
+		for idx := range rules {
+			if !rules[idx].Matches(msg, lightstates) {
+				continue
+			}
+			fmt.Fprintf(out, "%d %s %s: rule %s fires\n", lineno, msg.ts.Format("2006-01-02 15:04"), msg.topic, rules[idx].Name)
+			for _, aon := range rules[idx].Actions {
+				fmt.Fprintf(out, "\taction %s %s\n", aon.Name, aon.Action)
+				if nm, isbasiclight := actionname_map_[aon.Name].(ActionBasicLight); isbasiclight && nm.light < len(lightstates) {
+					lightstates[nm.light] = aon.Action == "on" || aon.Action == "1"
+				}
+			}
+			for _, pub := range rules[idx].Publish {
+				amsg := pub.ToActionMQTTMsg()
+				fmt.Fprintf(out, "\tpublish %s %s\n", amsg.topic, amsg.payload)
+			}
+		}
+	}
+	return linescanner.Err()
+}
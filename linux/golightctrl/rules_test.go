@@ -0,0 +1,245 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+func TestMQTTTopicMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"realraum/backdoorcx/ajar", "realraum/backdoorcx/ajar", true},
+		{"realraum/backdoorcx/ajar", "realraum/frontdoor/ajar", false},
+		{"realraum/+/illumination", "realraum/pillar/illumination", true},
+		{"realraum/+/illumination", "realraum/pillar/temperature", false},
+		{"realraum/+/illumination", "realraum/illumination", false},
+		{"realraum/#", "realraum/pillar/illumination", true},
+		{"realraum/#", "realraum", true}, //# also matches the parent level
+		{"#", "action/GoLightCtrl/ceiling1", true},
+		{"+", "realraum", true},
+		{"+", "realraum/pillar", false},
+		{"realraum/pillar", "realraum/pillar/illumination", false},
+		{"realraum/pillar/illumination", "realraum/pillar", false},
+	}
+	for _, tc := range tests {
+		if got := mqttTopicMatchesFilter(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("mqttTopicMatchesFilter(%q, %q) = %t, want %t", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestJSONPathLookup(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"Shut":false,"fade":{"duration":500,"cc":[10,20]},"Who":"xro"}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"Shut", false, true},
+		{"Who", "xro", true},
+		{"fade.duration", 500.0, true},
+		{"fade.cc.1", 20.0, true},
+		{"fade.cc.2", nil, false},
+		{"fade.cc.-1", nil, false},
+		{"fade.cc.x", nil, false},
+		{"fade.missing", nil, false},
+		{"Who.first", nil, false},
+		{"missing", nil, false},
+		{"", data, true},
+	}
+	for _, tc := range tests {
+		got, found := jsonPathLookup(data, tc.path)
+		if found != tc.found || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("jsonPathLookup(%q) = %v, %t, want %v, %t", tc.path, got, found, tc.want, tc.found)
+		}
+	}
+}
+
+func TestRuleMatchesTime(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		ts, _ := time.ParseInLocation("15:04", hhmm, time.Local)
+		return ts
+	}
+	tests := []struct {
+		after, before, now string
+		want               bool
+	}{
+		{"", "", "03:00", true},
+		{"08:00", "18:00", "12:00", true},
+		{"08:00", "18:00", "08:00", true},
+		{"08:00", "18:00", "18:00", false},
+		{"08:00", "18:00", "07:59", false},
+		{"20:00", "06:00", "23:30", true},
+		{"20:00", "06:00", "05:59", true},
+		{"20:00", "06:00", "06:00", false},
+		{"20:00", "06:00", "12:00", false},
+		{"20:00", "", "23:59", true},
+		{"20:00", "", "19:59", false},
+		{"", "06:00", "00:00", true},
+		{"", "06:00", "06:01", false},
+	}
+	for _, tc := range tests {
+		rule := Rule{After: tc.after, Before: tc.before}
+		if got := rule.matchesTime(at(tc.now)); got != tc.want {
+			t.Errorf("After %q Before %q at %s: got %t, want %t", tc.after, tc.before, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	noon := time.Date(2019, 6, 12, 12, 0, 0, 0, time.Local)
+	night := time.Date(2019, 6, 12, 23, 0, 0, 0, time.Local)
+	ceiling1on := []bool{true, false, false, false, false, false}
+	tests := []struct {
+		name    string
+		rule    Rule
+		topic   string
+		payload string
+		ts      time.Time
+		lights  []bool
+		want    bool
+	}{
+		{"topic and condition", Rule{Topic: "realraum/backdoorcx/ajar", Conditions: []RuleCondition{{Path: "Shut", Value: false}}},
+			"realraum/backdoorcx/ajar", `{"Shut":false}`, noon, nil, true},
+		{"condition fails", Rule{Topic: "realraum/backdoorcx/ajar", Conditions: []RuleCondition{{Path: "Shut", Value: false}}},
+			"realraum/backdoorcx/ajar", `{"Shut":true}`, noon, nil, false},
+		{"other topic", Rule{Topic: "realraum/backdoorcx/ajar"},
+			"realraum/frontdoor/ajar", `{"Shut":false}`, noon, nil, false},
+		{"number comparison", Rule{Topic: "realraum/+/illumination", Conditions: []RuleCondition{{Path: "Value", Op: ">", Value: 900.0}}},
+			"realraum/pillar/illumination", `{"Value":950}`, noon, nil, true},
+		{"number comparison fails", Rule{Topic: "realraum/+/illumination", Conditions: []RuleCondition{{Path: "Value", Op: ">", Value: 900.0}}},
+			"realraum/pillar/illumination", `{"Value":850}`, noon, nil, false},
+		{"all conditions must hold", Rule{Topic: "t", Conditions: []RuleCondition{{Path: "a", Value: 1.0}, {Path: "b", Op: "exists"}}},
+			"t", `{"a":1}`, noon, nil, false},
+		{"!exists", Rule{Topic: "t", Conditions: []RuleCondition{{Path: "b", Op: "!exists"}}},
+			"t", `{"a":1}`, noon, nil, true},
+		{"plain payload", Rule{Topic: "action/couchred/power", Conditions: []RuleCondition{{Value: "on"}}},
+			"action/couchred/power", `on`, noon, nil, true},
+		{"inside time window", Rule{Topic: "t", After: "20:00", Before: "06:00"},
+			"t", `{}`, night, nil, true},
+		{"outside time window", Rule{Topic: "t", After: "20:00", Before: "06:00"},
+			"t", `{}`, noon, nil, false},
+		{"light on as required", Rule{Topic: "t", LightsOn: []string{"ceiling1"}},
+			"t", `{}`, noon, ceiling1on, true},
+		{"light off but must be on", Rule{Topic: "t", LightsOn: []string{"ceiling2"}},
+			"t", `{}`, noon, ceiling1on, false},
+		{"light on but must be off", Rule{Topic: "t", LightsOff: []string{"ceiling1"}},
+			"t", `{}`, noon, ceiling1on, false},
+		{"unknown light state counts as off", Rule{Topic: "t", LightsOff: []string{"ceiling6"}},
+			"t", `{}`, noon, nil, true},
+	}
+	for _, tc := range tests {
+		msg := RuleMQTTMsg{filter: tc.rule.Topic, topic: tc.topic, payload: []byte(tc.payload), ts: tc.ts}
+		if got := tc.rule.Matches(msg, tc.lights); got != tc.want {
+			t.Errorf("%s: Matches = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRuleLoops(t *testing.T) {
+	publish := func(topic string) []JsonMQTTMsg {
+		return []JsonMQTTMsg{{Topic: topic, Payload: json.RawMessage(`"off"`)}}
+	}
+	tests := []struct {
+		name  string
+		rules []Rule
+		loops bool
+	}{
+		{"no loop", []Rule{
+			{Name: "couch", Topic: "realraum/+/illumination", Publish: publish("action/couchred/power")},
+			{Name: "door", Topic: "realraum/backdoorcx/ajar", Actions: []r3events.LightCtrlActionOnName{{Name: "ceiling6", Action: "on"}}},
+		}, false},
+		{"fires itself", []Rule{
+			{Name: "echo", Topic: "realraum/+/illumination", Publish: publish("realraum/pillar/illumination")},
+		}, true},
+		{"fires each other", []Rule{
+			{Name: "ping", Topic: "test/ping", Publish: publish("test/pong")},
+			{Name: "pong", Topic: "test/#", Publish: publish("test/other")},
+		}, true},
+		{"fires another through an action name", []Rule{
+			{Name: "couch", Topic: "realraum/+/illumination", Actions: []r3events.LightCtrlActionOnName{{Name: "couchred", Action: "off"}}},
+			{Name: "couch follows", Topic: "action/+/power", Publish: publish("action/PipeLEDs/pattern")},
+		}, true},
+	}
+	for _, tc := range tests {
+		if err := checkRuleLoops(tc.rules); (err != nil) != tc.loops {
+			t.Errorf("%s: %v, want loop found %t", tc.name, err, tc.loops)
+		}
+	}
+}
+
+func TestReplayRules(t *testing.T) {
+	rules := []Rule{
+		{Name: "door at night", Topic: "realraum/backdoorcx/ajar", Conditions: []RuleCondition{{Path: "Shut", Value: false}},
+			After: "20:00", Before: "06:00", LightsOff: []string{"ceiling6"}, Actions: []r3events.LightCtrlActionOnName{{Name: "ceiling6", Action: "on"}}},
+		{Name: "couch", Topic: "realraum/+/illumination", Conditions: []RuleCondition{{Path: "Value", Op: ">", Value: 900.0}},
+			Publish: []JsonMQTTMsg{{Topic: "action/couchred/power", Payload: json.RawMessage(`"off"`)}}},
+	}
+	night := time.Date(2019, 6, 12, 23, 0, 0, 0, time.Local)
+	noon := time.Date(2019, 6, 12, 12, 0, 0, 0, time.Local)
+	recording := fmt.Sprintf(`{"Topic": "realraum/backdoorcx/ajar", "Payload": {"Shut": false}, "Ts": %d}
+{"Topic": "realraum/backdoorcx/ajar", "Payload": {"Shut": false}, "Ts": %d}
+
+{"Topic": "realraum/backdoorcx/ajar", "Payload": {"Shut": false}, "Ts": %d}
+{"Topic": "realraum/pillar/illumination", "Payload": {"Value": 950}, "Ts": %d}
+`, noon.Unix(), night.Unix(), night.Unix(), noon.Unix())
+	fh, err := ioutil.TempFile("", "golightctrl_replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fh.WriteString(recording)
+	fh.Close()
+	var out bytes.Buffer
+	if err := ReplayRules(rules, fh.Name(), &out); err != nil {
+		t.Fatal(err)
+	}
+	//the second door message finds ceiling6 already switched on by the first one at night
+	want := "2 2019-06-12 23:00 realraum/backdoorcx/ajar: rule door at night fires\n" +
+		"\taction ceiling6 on\n" +
+		"5 2019-06-12 12:00 realraum/pillar/illumination: rule couch fires\n" +
+		"\tpublish action/couchred/power off\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	if err := ReplayRules(rules, fh.Name()+".missing", &out); err == nil {
+		t.Error("no error for missing recording")
+	}
+}
+
+// nobody takes what rules switch once we shut down, Execute must not wait for it
+func TestRuleExecuteGivesUpOnShutdown(t *testing.T) {
+	defer drainSwitchedNames()
+	defer drainMQTTTopics()
+	for len(switch_name_chan_) < cap(switch_name_chan_) {
+		switch_name_chan_ <- r3events.LightCtrlActionOnName{Name: "basiclight1", Action: "on"}
+	}
+	rule := Rule{Name: "full", Actions: []r3events.LightCtrlActionOnName{{Name: "basiclight2", Action: "on"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		rule.Execute(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execute still waiting for switch_name_chan_ after shutdown")
+	}
+}
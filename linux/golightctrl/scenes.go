@@ -0,0 +1,341 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btittelbach/pubsub"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	DEFAULT_GOLIGHTCTRL_SCENESFILE string = "golightctrl_scenes.json"
+	SceneDeviceFancy                      = "fancy"
+	SceneDeviceSonoff                     = "sonoff"
+	SceneDeviceESPHome                    = "esphome"
+	SceneDeviceZigbee2MQTT                = "zigbee2mqtt"
+	SceneSave                             = "save"
+	SceneRestore                          = "restore"
+	SceneDelete                           = "delete"
+	scene_capture_delay_                  = 2 * time.Second // for fancy lights to answer pleaserepeat before we take a scene
+)
+
+var (
+	topic_scene_cmd_  string = topic_lightctrl_pre_ + "scene"
+	topic_scene_list_ string = topic_lightctrl_state_pre_ + "scenes"
+)
+
+// rf outlets are stateless, so we remember what we last sent them
+var scene_rf_names_ = sceneRFNames()
+
+var scene_mqtt_devices_ = sceneMQTTDevices()
+
+// names a scene must never switch, whatever we last sent them
+var scene_ignored_names_ = []string{"olgatemp"}
+
+// e.g. "scenevortrag": ActionMQTTMsg{topic_scene_cmd_, payload_scene(SceneRestore, "vortrag")} in actionname_map_
+func payload_scene(action, name string) []byte {
+	return r3events.MarshalEvent2ByteOrPanic(r3events.LightCtrlActionOnName{Name: name, Action: action})
+}
+
+// the rf outlets in actionname_map_
+func sceneRFNames() []string {
+	var names []string
+	for name, nmi := range actionname_map_ {
+		if _, isrf := nmi.(ActionRFCode); isrf && !stringInSlice(name, scene_ignored_names_) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the devices actionname_map_ sends messages to, that we know how to restore
+func sceneMQTTDevices() []SceneMQTTDevice {
+	var devices []SceneMQTTDevice
+	seen := make(map[string]bool, len(actionname_map_))
+	for _, nmi := range actionname_map_ {
+		nm, ismsg := nmi.(ActionMQTTMsg)
+		if !ismsg || seen[nm.topic] {
+			continue
+		}
+		seen[nm.topic] = true
+		if dev, known := sceneMQTTDeviceFor(nm.topic); known {
+			devices = append(devices, dev)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].restoretopic < devices[j].restoretopic })
+	return devices
+}
+
+// tells from the topic we send to what kind of device listens there and where it tells us its state.
+// Fancy lights report their state on their own topic, when they change on their own or are asked with pleaserepeat.
+// Sonoffs run tasmota, which takes commands case-insensitively and reports on stat/<x>/POWER
+func sceneMQTTDeviceFor(topic string) (SceneMQTTDevice, bool) {
+	switch {
+	case topic == fancytopic_all:
+		return SceneMQTTDevice{}, false //the single lights tell us their state
+	case strings.HasSuffix(topic, "/"+r3events.TYPE_LIGHT):
+		return SceneMQTTDevice{SceneDeviceFancy, topic, topic}, true
+	case strings.HasPrefix(topic, r3events.TOPIC_ACTIONS) && strings.EqualFold(topic[strings.LastIndex(topic, "/")+1:], "power"):
+		name := strings.TrimPrefix(topic[:strings.LastIndex(topic, "/")], r3events.TOPIC_ACTIONS)
+		return SceneMQTTDevice{SceneDeviceSonoff, "stat/" + name + "/POWER", topic}, true
+	case strings.HasPrefix(topic, r3events.TOPIC_ACTIONS) && strings.HasSuffix(topic, "/command"):
+		name := strings.TrimSuffix(strings.TrimPrefix(topic, r3events.TOPIC_ACTIONS), "/command")
+		return SceneMQTTDevice{SceneDeviceESPHome, r3events.TOPIC_R3 + name + "/state", topic}, true
+	case strings.HasPrefix(topic, "zigbee2mqtt/") && strings.HasSuffix(topic, "/set"):
+		return SceneMQTTDevice{SceneDeviceZigbee2MQTT, strings.TrimSuffix(topic, "/set"), topic}, true
+	}
+	return SceneMQTTDevice{}, false
+}
+
+// keeps only the keys of a json object that are needed to restore a device
+func filterJSONObject(payload []byte, keys ...string) (json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return nil, err
+	}
+	filtered := make(map[string]json.RawMessage, len(keys))
+	for _, key := range keys {
+		if value, inmap := obj[key]; inmap {
+			filtered[key] = value
+		}
+	}
+	return json.Marshal(filtered)
+}
+
+// converts what a device reports into what we need to send it to get back to that state
+func (dev SceneMQTTDevice) restorePayload(statepayload []byte) (json.RawMessage, error) {
+	switch dev.kind {
+	case SceneDeviceFancy:
+		var fl r3events.FancyLight
+		if err := json.Unmarshal(statepayload, &fl); err != nil {
+			return nil, err
+		}
+		fl.Fade, fl.Flash = nil, nil
+		return json.Marshal(fl)
+	case SceneDeviceSonoff:
+		state := strings.ToUpper(strings.TrimSpace(string(statepayload)))
+		if state != "ON" && state != "OFF" {
+			return nil, fmt.Errorf("unknown sonoff state %s", state)
+		}
+		return json.Marshal(state)
+	case SceneDeviceESPHome, SceneDeviceZigbee2MQTT:
+		return filterJSONObject(statepayload, "state", "brightness", "color_temp", "color", "white_value")
+	}
+	return nil, fmt.Errorf("unknown device kind %s", dev.kind)
+}
+
+func LoadScenes(filename string) (map[string]*Scene, error) {
+	scenes := make(map[string]*Scene)
+	if err := LoadJSONConfigFile(filename, &scenes); err != nil && !os.IsNotExist(err) {
+		return scenes, err
+	}
+	return scenes, nil
+}
+
+// write to temp file first, so a crash never leaves us with half a scenes file
+func SaveScenes(filename string, scenes map[string]*Scene) error {
+	data, err := json.MarshalIndent(scenes, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpfilename := filename + ".tmp"
+	if err = ioutil.WriteFile(tmpfilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfilename, filename)
+}
+
+func sortedSceneNames(scenes map[string]*Scene) []string {
+	names := make([]string, 0, len(scenes))
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func subscribeSceneTopics(mqttc mqtt.Client) {
+	for _, dev := range scene_mqtt_devices_ {
+		dev := dev
+		SubscribeAndAttachCallback(mqttc, dev.statetopic, func(c mqtt.Client, msg mqtt.Message) {
+			payload, err := dev.restorePayload(msg.Payload())
+			if err != nil {
+				LogMain_.Printf("Scenes: ignoring state on %s: %s", msg.Topic(), err)
+				return
+			}
+			select {
+			case scene_device_state_chan_ <- SceneDeviceState{restoretopic: dev.restoretopic, payload: payload}:
+			default:
+				LogMain_.Printf("Scenes: dropping state update for %s", dev.restoretopic)
+			}
+		})
+	}
+	SubscribeAndAttachCallback(mqttc, topic_scene_cmd_, func(c mqtt.Client, msg mqtt.Message) {
+		var aon r3events.LightCtrlActionOnName
+		if msg.Retained() {
+			return
+		}
+		if err := json.Unmarshal(msg.Payload(), &aon); err != nil {
+			LogMain_.Printf("Scenes: Error: %s", err)
+			return
+		}
+		select {
+		case scene_cmd_chan_ <- aon:
+		default:
+			LogMain_.Printf("Scenes: dropping %+v", aon)
+		}
+	})
+	askFancyLightsForState(mqttc)
+}
+
+// makes fancy lights tell us their current state, also after changes we never saw or commands sent before we started
+func askFancyLightsForState(mqttc mqtt.Client) {
+	if mqttc == nil {
+		return
+	}
+	mqttc.Publish(r3events.ACT_ALLFANCYLIGHT_PLEASEREPEAT, MQTT_QOS_NOCONFIRMATION, false, []byte{})
+}
+
+func publishSceneList(mqttc mqtt.Client, scenes map[string]*Scene) {
+	if mqttc == nil {
+		return
+	}
+	mqttc.Publish(topic_scene_list_, MQTT_QOS_REQCONFIRMATION, true, r3events.MarshalEvent2ByteOrPanic(sortedSceneNames(scenes)))
+}
+
+func captureScene(devices map[string]json.RawMessage, rfoutlets map[string]bool) *Scene {
+	scene := &Scene{
+		BasicLights: make(map[string]bool, num_basicctrl_relays_),
+		RFOutlets:   make(map[string]bool, len(rfoutlets)),
+		Devices:     make(map[string]json.RawMessage, len(devices)),
+		Ts:          time.Now().Unix(),
+	}
+	for idx, onoff := range CeilingLightsSwitch_.GetCeilingLightsStates() {
+		name := fmt.Sprintf("basiclight%d", idx+1)
+		if _, inmap := actionname_map_[name]; inmap {
+			scene.BasicLights[name] = onoff
+		}
+	}
+	for name, onoff := range rfoutlets {
+		scene.RFOutlets[name] = onoff
+	}
+	for topic, payload := range devices {
+		scene.Devices[topic] = payload
+	}
+	return scene
+}
+
+// switches and publishes what the scene remembers, unless ctx is done first
+func restoreScene(ctx context.Context, scene *Scene) {
+	for name, onoff := range scene.BasicLights {
+		if !switchNameUnlessDone(ctx, r3events.LightCtrlActionOnName{Name: name, Action: IfThenElseStr(onoff, "on", "off")}) {
+			return
+		}
+	}
+	for name, onoff := range scene.RFOutlets {
+		if !switchNameUnlessDone(ctx, r3events.LightCtrlActionOnName{Name: name, Action: IfThenElseStr(onoff, "on", "off")}) {
+			return
+		}
+	}
+	for topic, payload := range scene.Devices {
+		//the scenes file is indented, our small devices prefer their json on one line
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, payload); err == nil {
+			payload = compacted.Bytes()
+		}
+		if !sendMQTTUnlessDone(ctx, JsonMQTTMsg{Topic: topic, Payload: payload}.ToActionMQTTMsg()) {
+			return
+		}
+	}
+}
+
+// keeps track of the current room state and saves, restores and deletes scenes on command.
+// A save still waiting for the lights to report is finished before returning once ctx is done
+func goManageScenes(ctx context.Context, ps *pubsub.PubSub, scenesfile string, mqttc mqtt.Client) {
+	rf_c := ps.Sub(PS_RF_SWITCHED)
+	defer ps.Unsub(rf_c)
+	devices := make(map[string]json.RawMessage, len(scene_mqtt_devices_))
+	rfoutlets := make(map[string]bool, len(scene_rf_names_))
+	scenes, err := LoadScenes(scenesfile)
+	if err != nil {
+		LogMain_.Printf("Scenes: can't load %s: %s", scenesfile, err)
+	}
+	publishSceneList(mqttc, scenes)
+	var capture_c <-chan time.Time
+	var tocapture []string
+	saveAndPublish := func() {
+		if err := SaveScenes(scenesfile, scenes); err != nil {
+			LogMain_.Printf("Scenes: can't save %s: %s", scenesfile, err)
+		}
+		publishSceneList(mqttc, scenes)
+	}
+	capture := func() {
+		capture_c = nil
+		for _, name := range tocapture {
+			scenes[name] = captureScene(devices, rfoutlets)
+		}
+		tocapture = nil
+		saveAndPublish()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if capture_c != nil {
+				capture()
+			}
+			return
+		case <-capture_c:
+			capture()
+		case devstate := <-scene_device_state_chan_:
+			devices[devstate.restoretopic] = devstate.payload
+		case evt, isopen := <-rf_c:
+			if !isopen {
+				rf_c = ps.Sub(PS_RF_SWITCHED)
+				continue
+			}
+			if na, ok := evt.(NameAction); ok && stringInSlice(na.name, scene_rf_names_) {
+				rfoutlets[na.name] = na.onoff
+			}
+		case cmd := <-scene_cmd_chan_:
+			if len(cmd.Name) == 0 || strings.ContainsAny(cmd.Name, "/+#") {
+				LogMain_.Printf("Scenes: invalid scene name %s", cmd.Name)
+				continue
+			}
+			LogMain_.Printf("Scenes: %s %s", cmd.Action, cmd.Name)
+			switch cmd.Action {
+			case SceneRestore:
+				if scene, inmap := scenes[cmd.Name]; inmap {
+					restoreScene(ctx, scene)
+				} else {
+					LogMain_.Printf("Scenes: unknown scene %s", cmd.Name)
+				}
+				continue
+			case SceneSave:
+				//what fancy lights last reported may be older than a command they got since
+				if capture_c == nil {
+					askFancyLightsForState(mqttc)
+					capture_c = time.After(scene_capture_delay_)
+				}
+				if !stringInSlice(cmd.Name, tocapture) {
+					tocapture = append(tocapture, cmd.Name)
+				}
+			case SceneDelete:
+				delete(scenes, cmd.Name)
+				saveAndPublish()
+			default:
+				LogMain_.Printf("Scenes: unknown action %s", cmd.Action)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type fakeCeilingLights struct {
+	states []bool
+}
+
+func (f *fakeCeilingLights) GetCeilingLightsStates() []bool              { return f.states }
+func (f *fakeCeilingLights) ReadCeilingLightsStates() ([]bool, error)    { return f.states, nil }
+func (f *fakeCeilingLights) SetCeilingLightsState(light int, onoff bool) { f.states[light] = onoff }
+func (f *fakeCeilingLights) SetCeilingLightsStates(states []bool)        { copy(f.states, states) }
+func (f *fakeCeilingLights) Close()                                      {}
+
+func TestSceneMQTTDeviceFor(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  SceneMQTTDevice
+		known bool
+	}{
+		{fancytopic(1), SceneMQTTDevice{SceneDeviceFancy, fancytopic(1), fancytopic(1)}, true},
+		{fancytopic_all, SceneMQTTDevice{}, false},
+		{sonofftopic("couchred"), SceneMQTTDevice{SceneDeviceSonoff, "stat/couchred/POWER", "action/couchred/power"}, true},
+		{"action/couchred/POWER", SceneMQTTDevice{SceneDeviceSonoff, "stat/couchred/POWER", "action/couchred/POWER"}, true},
+		{"action/olgadecke/command", SceneMQTTDevice{SceneDeviceESPHome, "realraum/olgadecke/state", "action/olgadecke/command"}, true},
+		{"zigbee2mqtt/w1/OutletBlueLEDBar/set", SceneMQTTDevice{SceneDeviceZigbee2MQTT, "zigbee2mqtt/w1/OutletBlueLEDBar", "zigbee2mqtt/w1/OutletBlueLEDBar/set"}, true},
+		{topic_scene_cmd_, SceneMQTTDevice{}, false},
+		{"action/ceilingscripts/activatescript", SceneMQTTDevice{}, false},
+	}
+	for _, tc := range tests {
+		dev, known := sceneMQTTDeviceFor(tc.topic)
+		if known != tc.known || dev != tc.want {
+			t.Errorf("sceneMQTTDeviceFor(%s) = %+v, %t, want %+v, %t", tc.topic, dev, known, tc.want, tc.known)
+		}
+	}
+}
+
+func TestSceneDevicesFromActionNames(t *testing.T) {
+	if stringInSlice("olgatemp", scene_rf_names_) {
+		t.Error("scenes would switch olgatemp")
+	}
+	for _, name := range []string{"regalleinwand", "bluebar", "spots", "abwasch"} {
+		if !stringInSlice(name, scene_rf_names_) {
+			t.Errorf("rf outlet %s missing from scenes", name)
+		}
+	}
+	topics := make([]string, 0, len(scene_mqtt_devices_))
+	for _, dev := range scene_mqtt_devices_ {
+		topics = append(topics, dev.restoretopic)
+	}
+	for _, topic := range []string{fancytopic(1), fancytopic(6), sonofftopic("couchred")} {
+		if !stringInSlice(topic, topics) {
+			t.Errorf("device %s missing from scenes", topic)
+		}
+	}
+	if stringInSlice(fancytopic_all, topics) || stringInSlice(topic_scene_cmd_, topics) {
+		t.Errorf("scenes restore %v", topics)
+	}
+}
+
+func TestSceneRestorePayload(t *testing.T) {
+	tests := []struct {
+		kind, state, want string
+		ok                bool
+	}{
+		{SceneDeviceFancy, `{"r":10,"g":0,"b":0,"cw":100,"ww":0,"fade":{"duration":500}}`, `{"r":10,"g":0,"b":0,"cw":100,"ww":0}`, true},
+		{SceneDeviceFancy, `not json`, ``, false},
+		{SceneDeviceSonoff, `on`, `"ON"`, true},
+		{SceneDeviceSonoff, ` OFF `, `"OFF"`, true},
+		{SceneDeviceSonoff, `toggle`, ``, false},
+		{SceneDeviceESPHome, `{"state":"ON","brightness":128,"effect":"none"}`, `{"brightness":128,"state":"ON"}`, true},
+		{SceneDeviceZigbee2MQTT, `{"state":"OFF","linkquality":42}`, `{"state":"OFF"}`, true},
+		{"unknown", `{}`, ``, false},
+	}
+	for _, tc := range tests {
+		dev := SceneMQTTDevice{kind: tc.kind}
+		payload, err := dev.restorePayload([]byte(tc.state))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s %s: error %v", tc.kind, tc.state, err)
+			continue
+		}
+		if tc.ok && string(payload) != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.kind, tc.state, payload, tc.want)
+		}
+	}
+}
+
+func TestSceneCaptureSaveRestore(t *testing.T) {
+	saved := CeilingLightsSwitch_
+	defer func() { CeilingLightsSwitch_ = saved }()
+	CeilingLightsSwitch_ = &fakeCeilingLights{states: []bool{true, false, true, false, false, true}}
+
+	devices := map[string]json.RawMessage{
+		fancytopic(1):              json.RawMessage(`{"r":0,"g":0,"b":0,"cw":100,"ww":0}`),
+		sonofftopic("couchred"):    json.RawMessage(`"ON"`),
+		"action/olgadecke/command": json.RawMessage(`{"state":"OFF"}`),
+	}
+	rfoutlets := map[string]bool{"bluebar": true, "logo": false}
+	scene := captureScene(devices, rfoutlets)
+	//later changes must not end up in the scene we took
+	devices[fancytopic(1)] = json.RawMessage(`{}`)
+	rfoutlets["bluebar"] = false
+
+	dir, err := ioutil.TempDir("", "golightctrl_scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scenesfile := filepath.Join(dir, "scenes.json")
+	if err := SaveScenes(scenesfile, map[string]*Scene{"vortrag": scene}); err != nil {
+		t.Fatal(err)
+	}
+	scenes, err := LoadScenes(scenesfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sortedSceneNames(scenes), []string{"vortrag"}) {
+		t.Fatalf("loaded scenes %v", sortedSceneNames(scenes))
+	}
+
+	restoreScene(context.Background(), scenes["vortrag"])
+	switched := drainSwitchedNames()
+	sort.Strings(switched)
+	wantswitched := []string{"basiclight1:on", "basiclight2:off", "basiclight3:on", "basiclight4:off", "basiclight5:off", "basiclight6:on", "bluebar:on", "logo:off"}
+	if !reflect.DeepEqual(switched, wantswitched) {
+		t.Errorf("restore switched %v, want %v", switched, wantswitched)
+	}
+	sent := make(map[string]string)
+	for {
+		select {
+		case msg := <-MQTT_chan_:
+			sent[msg.topic] = string(msg.payload)
+			continue
+		default:
+		}
+		break
+	}
+	wantsent := map[string]string{
+		fancytopic(1):              `{"r":0,"g":0,"b":0,"cw":100,"ww":0}`,
+		sonofftopic("couchred"):    `ON`,
+		"action/olgadecke/command": `{"state":"OFF"}`,
+	}
+	if !reflect.DeepEqual(sent, wantsent) {
+		t.Errorf("restore sent %v, want %v", sent, wantsent)
+	}
+}
+
+func TestLoadScenesWithoutFile(t *testing.T) {
+	scenes, err := LoadScenes(filepath.Join(os.TempDir(), "golightctrl_no_such_scenes.json"))
+	if err != nil || len(scenes) != 0 {
+		t.Errorf("LoadScenes of missing file: %v, %v", scenes, err)
+	}
+}
@@ -39,14 +39,16 @@ func openTTY(name string, speed uint) (port *sio.Port, err error) {
 	return
 }
 
-func serialWriter(in <-chan SerialLine, serial *sio.Port) {
+// closes the tty once in is closed, e.g. on shutdown
+func serialWriter(in <-chan SerialLine, serial *sio.Port, closed chan struct{}) {
 	for totty := range in {
 		serial.Write(totty)
 	}
+	close(closed)
 	serial.Close()
 }
 
-func serialReader(out chan<- SerialLine, serial *sio.Port) {
+func serialReader(out chan<- SerialLine, serial *sio.Port, closed chan struct{}) {
 	linescanner := bufio.NewScanner(serial)
 	linescanner.Split(bufio.ScanLines)
 	for linescanner.Scan() {
@@ -56,6 +58,11 @@ func serialReader(out chan<- SerialLine, serial *sio.Port) {
 		}
 		out <- text
 	}
+	select {
+	case <-closed:
+		return //we closed it ourselves
+	default:
+	}
 	if err := linescanner.Err(); err != nil {
 		panic(err.Error())
 	}
@@ -69,7 +76,8 @@ func OpenAndHandleSerial(filename string, serspeed uint) (chan SerialLine, chan
 	}
 	wr := make(chan SerialLine, 1)
 	rd := make(chan SerialLine, 20)
-	go serialWriter(wr, serial)
-	go serialReader(rd, serial)
+	closed := make(chan struct{})
+	go serialWriter(wr, serial, closed)
+	go serialReader(rd, serial, closed)
 	return wr, rd, nil
 }
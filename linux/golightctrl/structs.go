@@ -2,23 +2,33 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"sync"
+	"time"
 
 	bbhw "github.com/btittelbach/go-bbhw"
 	"github.com/realraum/door_and_sensors/r3events"
 )
 
 type CeilingLightsSwitch interface {
-	GetCeilingLightsStates() []bool
+	GetCeilingLightsStates() []bool           // last known state. Reads GPIO each time if nobody polls them
+	ReadCeilingLightsStates() ([]bool, error) // reads back the actual state from the hardware
 	SetCeilingLightsState(ceiling_light_number int, onoff bool)
 	SetCeilingLightsStates([]bool)
+	Close() // releases gpio lines or tty, once nobody switches anymore
 }
 
 type SerialLine []byte
 
 type CeilingLightStateMap map[string]bool
 
-type CeilingLightsSwitchGPIO []bbhw.GPIOControllablePin
+type CeilingLightsSwitchGPIO struct {
+	gpios       []bbhw.GPIOControllablePin
+	state       []bool
+	state_mutex sync.RWMutex
+	polled      bool
+}
 type CeilingLightsSwitchBasicCtrl BasicCtrlBox
 
 type BasicCtrlBox struct {
@@ -26,6 +36,28 @@ type BasicCtrlBox struct {
 	wr          chan SerialLine
 	state       []bool
 	state_mutex sync.RWMutex
+	answered    chan struct{}
+}
+
+//wraps a CeilingLightsSwitch and remembers what we last told it to do
+type CeilingLightsTracker struct {
+	backend      CeilingLightsSwitch
+	commanded    []bool
+	actual       []bool
+	last_command time.Time
+	mutex        sync.Mutex
+}
+
+type BasicLightState struct {
+	On bool
+	Ts int64
+}
+
+type BasicLightDrift struct {
+	Light     string
+	Commanded bool
+	Actual    bool
+	Ts        int64
 }
 
 type jsonButtonUsed struct {
@@ -63,3 +95,127 @@ type RFCmdToSend struct {
 	handler string
 	code    []byte
 }
+
+// time.Duration that reads and writes as "1m30s" in json
+type JsonDuration struct {
+	time.Duration
+}
+
+type JsonMQTTMsg struct {
+	Topic   string
+	Payload json.RawMessage
+}
+
+// starts a timer like time.NewTimer, returning its channel and Stop
+type presenceTimerFunc func(d time.Duration) (<-chan time.Time, func() bool)
+
+type PresenceRules struct {
+	EmptyGracePeriod       JsonDuration                     // how long the space has to be empty before we run EmptyActions
+	EmptyWarnBefore        JsonDuration                     // send EmptyWarn this long before EmptyActions
+	EmptyWarn              []JsonMQTTMsg                    // e.g. flash the ceiling lights
+	EmptyActions           []r3events.LightCtrlActionOnName // e.g. everything off
+	ArriveAfterDarkActions []r3events.LightCtrlActionOnName // e.g. welcome scene
+}
+
+type RuleCondition struct {
+	Path  string      // dot separated path into the json payload, e.g. "fade.duration" or "cc.0". Empty means whole payload
+	Op    string      // one of == != < <= > >= exists !exists. Defaults to ==
+	Value interface{} // json value to compare with
+}
+
+type Rule struct {
+	Name       string
+	Topic      string // MQTT topic filter, may contain + and #
+	Conditions []RuleCondition
+	After      string   // optional time window "HH:MM", may wrap around midnight
+	Before     string   // optional time window "HH:MM"
+	LightsOn   []string // names of basic lights that must currently be on
+	LightsOff  []string // names of basic lights that must currently be off
+	Actions    []r3events.LightCtrlActionOnName
+	Publish    []JsonMQTTMsg
+}
+
+type RuleMQTTMsg struct {
+	filter  string
+	topic   string
+	payload []byte
+	ts      time.Time
+}
+
+// line format of files given to -replayrules
+type RecordedMQTTMsg struct {
+	Topic   string
+	Payload json.RawMessage // a json string is used verbatim as payload, anything else as json
+	Ts      int64
+}
+
+type Scene struct {
+	BasicLights map[string]bool            // basiclightN -> on
+	RFOutlets   map[string]bool            // actionname_map_ name -> on
+	Devices     map[string]json.RawMessage // topic -> payload that restores the device
+	Ts          int64
+}
+
+type SceneMQTTDevice struct {
+	kind         string
+	statetopic   string
+	restoretopic string
+}
+
+type SceneDeviceState struct {
+	restoretopic string
+	payload      json.RawMessage
+}
+
+type ACLSourcePolicy struct {
+	Source  string   // "button" or "mqtt:" followed by a topic prefix. The longest matching Source wins
+	Classes []string // classes of names this source may switch
+}
+
+type ACLConfig struct {
+	Classes      map[string][]string // class -> names, e.g. "infrastructure": ["olgatemp"]
+	DefaultClass string              // class of names not listed in Classes, defaults to "public"
+	Sources      []ACLSourcePolicy
+}
+
+type AccessControl struct {
+	classof      map[string]string
+	defaultclass string
+	sources      []ACLSourcePolicy
+}
+
+// Home Assistant MQTT discovery config of one actionname_map_ entry
+type HADiscoveryConfig struct {
+	Name                 string           `json:"name"`
+	UniqueId             string           `json:"unique_id"`
+	CommandTopic         string           `json:"command_topic"`
+	StateTopic           string           `json:"state_topic,omitempty"`
+	ValueTemplate        string           `json:"value_template,omitempty"`
+	PayloadOn            string           `json:"payload_on,omitempty"`
+	PayloadOff           string           `json:"payload_off,omitempty"`
+	PayloadPress         string           `json:"payload_press,omitempty"`
+	StateOn              string           `json:"state_on,omitempty"`
+	StateOff             string           `json:"state_off,omitempty"`
+	Optimistic           bool             `json:"optimistic,omitempty"`
+	AvailabilityTopic    string           `json:"availability_topic"`
+	AvailabilityTemplate string           `json:"availability_template"`
+	PayloadAvailable     string           `json:"payload_available"`
+	PayloadNotAvailable  string           `json:"payload_not_available"`
+	Device               HADiscoveryOwner `json:"device"`
+}
+
+type HADiscoveryOwner struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// one step of shutting down. Its goroutines stop taking new work once ctx is done, finish what is queued and return
+type shutdownStage struct {
+	name    string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	stopped bool
+	mutex   sync.Mutex
+}
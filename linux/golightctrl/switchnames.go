@@ -2,11 +2,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/btittelbach/pubsub"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/realraum/door_and_sensors/r3events"
 )
 
 const (
@@ -120,6 +122,9 @@ var actionname_map_ map[string]ActionNameHandler = map[string]ActionNameHandler{
 	"fancyvortrag":  ActionMeta{metaaction: []string{"fancy1off", "fancy6off", "fancy2cw1", "fancy5cw1", "fancy3cw2", "fancy4cw2", "floodtesla"}},
 	"allrf":         ActionMeta{metaaction: []string{"regalleinwand", "bluebar", "couchred", "couchwhite", "abwasch", "labortisch", "boiler", "boilerolga", "cxleds", "laserball", "logo", "ymhpower", "floodtesla"}},
 	"all":           ActionMeta{metaaction: []string{"regalleinwand", "bluebar", "couchred", "couchwhite", "abwasch", "labortisch", "boiler", "boilerolga", "cxleds", "ymhpower", "floodtesla", "laserball", "logo", "subtable", "ceiling1", "ceiling2", "ceiling3", "ceiling4", "ceiling5", "ceiling6"}},
+
+	//Scenes
+	"scenevortrag": ActionMQTTMsg{topic_scene_cmd_, payload_scene(SceneRestore, "vortrag")},
 }
 
 func ConvertCeilingLightsStateTomap(states []bool, offset int) CeilingLightStateMap {
@@ -131,9 +136,48 @@ func ConvertCeilingLightsStateTomap(states []bool, offset int) CeilingLightState
 	return rv
 }
 
-func GoSwitchNameAsync() {
+// switches what we are told until ctx is done, then what is still queued
+// hands aon to GoSwitchNameAsync, unless ctx is done first and nobody might take it anymore
+func switchNameUnlessDone(ctx context.Context, aon r3events.LightCtrlActionOnName) bool {
+	select {
+	case switch_name_chan_ <- aon:
+		return true
+	case <-ctx.Done():
+		LogMain_.Printf("shutting down, not switching %+v", aon)
+		return false
+	}
+}
+
+// queues msg for goSendMQTTMsg, unless ctx is done first and nobody might take it anymore
+func sendMQTTUnlessDone(ctx context.Context, msg ActionMQTTMsg) bool {
+	select {
+	case MQTT_chan_ <- msg:
+		return true
+	case <-ctx.Done():
+		LogMain_.Printf("shutting down, not publishing on %s", msg.topic)
+		return false
+	}
+}
+
+func GoSwitchNameAsync(ctx context.Context) {
+	draining := false
 FORLOOP:
-	for snc := range switch_name_chan_ {
+	for {
+		var snc r3events.LightCtrlActionOnName
+		if draining {
+			select {
+			case snc = <-switch_name_chan_:
+			default:
+				return
+			}
+		} else {
+			select {
+			case snc = <-switch_name_chan_:
+			case <-ctx.Done():
+				draining = true
+				continue FORLOOP
+			}
+		}
 		var onoff bool
 		switch snc.Action {
 		case "1", "on", "send", "{\"Action\":1}", "{\"Action\":\"on\"}", "{\"Action\":\"send\"}":
@@ -171,6 +215,7 @@ func SwitchName(name string, onoff bool) (err error) {
 			return fmt.Errorf("No valid code for action (%s,%t)", name, onoff)
 		}
 		RF433_linearize_chan_ <- RFCmdToSend{handler: nm.handler, code: code}
+		ps_.PubNonBlocking(NameAction{name, onoff}, PS_RF_SWITCHED)
 
 	case ActionMQTTMsg:
 		MQTT_chan_ <- nm
@@ -205,28 +250,38 @@ func SwitchName(name string, onoff bool) (err error) {
 	return
 }
 
-func goLinearizeRFSenders(ps *pubsub.PubSub, rfchan <-chan RFCmdToSend, rf433_tty_chan_ chan SerialLine, mqttc mqtt.Client) {
-	shutdown1_c := ps.SubOnce(PS_SHUTDOWN)
+// once ctx is done, sends the codes still queued and returns
+func goLinearizeRFSenders(ctx context.Context, ps *pubsub.PubSub, rfchan <-chan RFCmdToSend, rf433_tty_chan_ chan SerialLine, mqttc mqtt.Client) {
 	shutdown2_c := ps.SubOnce(PS_SHUTDOWN_CONSUMER)
 
+	send := func(rfcmd RFCmdToSend) {
+		switch rfcmd.handler {
+		case RFCode2TTY:
+			rf433_tty_chan_ <- append([]byte(">"), rfcmd.code...)
+			time.Sleep(POST_RF433_TTY_DELAY)
+		case RFCode2BOTH:
+			sendCodeToMQTT(mqttc, rfcmd.code)
+			time.Sleep(POST_RF433_MQTT_DELAY)
+			rf433_tty_chan_ <- append([]byte(">"), rfcmd.code...)
+			time.Sleep(POST_RF433_TTY_DELAY)
+		case RFCode2MQTT:
+			sendCodeToMQTT(mqttc, rfcmd.code)
+			time.Sleep(POST_RF433_MQTT_DELAY)
+		}
+	}
 	for {
 		select {
 		case rfcmd := <-rfchan:
-			switch rfcmd.handler {
-			case RFCode2TTY:
-				rf433_tty_chan_ <- append([]byte(">"), rfcmd.code...)
-				time.Sleep(POST_RF433_TTY_DELAY)
-			case RFCode2BOTH:
-				sendCodeToMQTT(mqttc, rfcmd.code)
-				time.Sleep(POST_RF433_MQTT_DELAY)
-				rf433_tty_chan_ <- append([]byte(">"), rfcmd.code...)
-				time.Sleep(POST_RF433_TTY_DELAY)
-			case RFCode2MQTT:
-				sendCodeToMQTT(mqttc, rfcmd.code)
-				time.Sleep(POST_RF433_MQTT_DELAY)
+			send(rfcmd)
+		case <-ctx.Done():
+			for {
+				select {
+				case rfcmd := <-rfchan:
+					send(rfcmd)
+				default:
+					return
+				}
 			}
-		case <-shutdown1_c:
-			return
 		case <-shutdown2_c:
 			return
 		}
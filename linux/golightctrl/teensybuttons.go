@@ -3,8 +3,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/realraum/door_and_sensors/r3events"
@@ -16,6 +18,13 @@ type NameAction struct {
 }
 
 const button_reset_timeout_ = time.Duration(7 * time.Second)
+const button_echo_timeout_ = 10 * time.Second
+
+// button presses on our own names we already handled, so we don't switch them again when our MQTT message comes back
+var (
+	button_echoes_      = make(map[string][]time.Time, 10)
+	button_echoes_lock_ sync.Mutex
+)
 
 var (
 	onaction  = []byte("{\"Action\":\"on\"}")
@@ -173,10 +182,16 @@ var name_actions_ [][]ButtonAction = [][]ButtonAction{
 }
 var corresponding_btn [15]int = [15]int{-1, 0, -1, 2, -1, 4, -1, 6, -1, 8, -1, 10, -1, -1, -1}
 
-func goListenForButtons(buttonchange_chan <-chan SerialLine) {
+func goListenForButtons(ctx context.Context, buttonchange_chan <-chan SerialLine) {
 	action_index := make([]int, len(name_actions_))
 	last_button_press := time.Now()
-	for btnchange := range buttonchange_chan {
+	for {
+		var btnchange SerialLine
+		select {
+		case <-ctx.Done():
+			return
+		case btnchange = <-buttonchange_chan:
+		}
 		if len(btnchange) < 3 {
 			LogBTN_.Println("Did not get enought bytes from SerialLine: ", btnchange)
 			continue
@@ -210,10 +225,54 @@ func goListenForButtons(buttonchange_chan <-chan SerialLine) {
 					action_index[bidx] = 0
 				}
 				for _, na := range btn_action_list[action_index[bidx]] {
-					MQTT_chan_ <- na
+					//switch our own names directly, so the ACL knows a button was pressed. Everybody else still learns of it on MQTT
+					if name, isname := lightctrlNameFromTopic(na.topic); isname {
+						aon := r3events.LightCtrlActionOnName{Name: name, Action: string(na.payload)}
+						if checkAccess(ACLSourceButton, aon) {
+							switchNameUnlessDone(ctx, aon)
+						}
+						expectButtonEcho(na)
+					}
+					sendMQTTUnlessDone(ctx, na)
 				}
 				action_index[bidx]++
 			}
 		}
 	}
 }
+
+func expectButtonEcho(na ActionMQTTMsg) {
+	button_echoes_lock_.Lock()
+	defer button_echoes_lock_.Unlock()
+	key := na.topic + " " + string(na.payload)
+	button_echoes_[key] = append(button_echoes_[key], time.Now())
+}
+
+// tells if a message on one of our name topics is what we published for a button press. Each press is recognized once
+func isButtonEcho(topic string, payload []byte) bool {
+	button_echoes_lock_.Lock()
+	defer button_echoes_lock_.Unlock()
+	now := time.Now()
+	//forget what never came back, e.g. while we were not connected
+	for key, pressed := range button_echoes_ {
+		for len(pressed) > 0 && now.Sub(pressed[0]) > button_echo_timeout_ {
+			pressed = pressed[1:]
+		}
+		if len(pressed) == 0 {
+			delete(button_echoes_, key)
+		} else {
+			button_echoes_[key] = pressed
+		}
+	}
+	key := topic + " " + string(payload)
+	pressed, inmap := button_echoes_[key]
+	if !inmap {
+		return false
+	}
+	if len(pressed) == 1 {
+		delete(button_echoes_, key)
+	} else {
+		button_echoes_[key] = pressed[1:]
+	}
+	return true
+}
@@ -2,7 +2,12 @@
 
 package main
 
-import "os"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
 
 func getFileMTime(filename string) (int64, error) {
 	keysfile, err := os.Open(filename)
@@ -32,3 +37,37 @@ func IfThenElseStr(c bool, strue, sfalse string) string {
 		return sfalse
 	}
 }
+
+func LoadJSONConfigFile(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (d *JsonDuration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+func (d JsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
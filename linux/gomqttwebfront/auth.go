@@ -0,0 +1,366 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AuthNone                              = ""
+	AuthPasswordFile                      = "passwordfile"
+	AuthProxyHeader                       = "proxyheader"
+	RoleNone                              = "none"
+	RoleGuest                             = "guest"
+	RoleMember                            = "member"
+	DEFAULT_GOMQTTWEBFRONT_PASSWORDFILE   = "gomqttwebfront.passwd"
+	DEFAULT_GOMQTTWEBFRONT_PROXYHEADER    = "X-Remote-User"
+	DEFAULT_GOMQTTWEBFRONT_ANONYMOUSROLE  = RoleGuest
+	DEFAULT_GOMQTTWEBFRONT_TRUSTEDPROXIES = "127.0.0.1,::1"
+	session_cookie_name_                  = "gomqttwebfront_session"
+	session_lifetime_                     = 30 * 24 * time.Hour
+	anonymous_user_name_                  = "anonymous"
+	basic_auth_cache_lifetime_            = 5 * time.Minute
+)
+
+var (
+	roles_           = []string{RoleNone, RoleGuest, RoleMember}
+	trusted_proxies_ []*net.IPNet
+	//compared against for unknown users, so timing does not tell which users exist
+	dummy_hash_, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+)
+
+func NewWebAuth(mode string) (*WebAuth, error) {
+	auth := &WebAuth{
+		mode:        mode,
+		passwdfile:  EnvironOrDefault("GOMQTTWEBFRONT_PASSWORDFILE", DEFAULT_GOMQTTWEBFRONT_PASSWORDFILE),
+		proxyheader: EnvironOrDefault("GOMQTTWEBFRONT_PROXYHEADER", DEFAULT_GOMQTTWEBFRONT_PROXYHEADER),
+		anonymous:   WebUser{Name: anonymous_user_name_, Role: RoleMember},
+		sessions:    make(map[string]*webSession, 10),
+		basicauth:   make(map[string]basicAuthEntry, 10),
+	}
+	switch mode {
+	case AuthNone:
+		return auth, nil
+	case AuthPasswordFile, AuthProxyHeader:
+	default:
+		return nil, fmt.Errorf("unknown GOMQTTWEBFRONT_AUTH %s", mode)
+	}
+	auth.anonymous.Role = EnvironOrDefault("GOMQTTWEBFRONT_ANONYMOUSROLE", DEFAULT_GOMQTTWEBFRONT_ANONYMOUSROLE)
+	if !stringInSlice(auth.anonymous.Role, roles_) {
+		return nil, fmt.Errorf("unknown GOMQTTWEBFRONT_ANONYMOUSROLE %s", auth.anonymous.Role)
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if err := auth.reloadPasswdFile(); err != nil && (mode == AuthPasswordFile || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// GOMQTTWEBFRONT_TRUSTEDPROXIES, comma separated addresses or networks like 127.0.0.1,10.0.0.0/8
+func SetTrustedProxies(spec string) error {
+	trusted_proxies_ = nil
+	for _, proxy := range strings.Split(spec, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if len(proxy) == 0 {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			proxy += IfThenElseStr(strings.Contains(proxy, ":"), "/128", "/32")
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("GOMQTTWEBFRONT_TRUSTEDPROXIES: %s", err)
+		}
+		trusted_proxies_ = append(trusted_proxies_, network)
+	}
+	return nil
+}
+
+// tells if r came directly from a reverse proxy whose headers we believe
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range trusted_proxies_ {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// one user per line: name:bcrypthash:role
+// in proxyheader mode the hash is ignored and users not listed get the anonymous role
+func (auth *WebAuth) reloadPasswdFile() error {
+	mtime, err := getFileMTime(auth.passwdfile)
+	if err != nil {
+		return err
+	}
+	if mtime == auth.passwd_mtime {
+		return nil
+	}
+	fh, err := os.Open(auth.passwdfile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	passwd := make(map[string]passwdEntry, 10)
+	linescanner := bufio.NewScanner(fh)
+	for lineno := 1; linescanner.Scan(); lineno++ {
+		line := strings.TrimSpace(linescanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected name:hash:role", auth.passwdfile, lineno)
+		}
+		if !stringInSlice(fields[2], roles_) {
+			return fmt.Errorf("%s:%d: unknown role %s", auth.passwdfile, lineno, fields[2])
+		}
+		passwd[fields[0]] = passwdEntry{hash: []byte(fields[1]), role: fields[2]}
+	}
+	if err := linescanner.Err(); err != nil {
+		return err
+	}
+	auth.passwd = passwd
+	auth.passwd_mtime = mtime
+	auth.basicauth = make(map[string]basicAuthEntry, 10) //passwords or roles may have changed
+	LogMain_.Printf("WebAuth: loaded %d users from %s", len(passwd), auth.passwdfile)
+	return nil
+}
+
+func newSessionToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+func (auth *WebAuth) Login(name, password string) (WebUser, error) {
+	auth.mutex.Lock()
+	if err := auth.reloadPasswdFile(); err != nil {
+		LogMain_.Printf("WebAuth: can't reload %s: %s", auth.passwdfile, err)
+	}
+	entry, inmap := auth.passwd[name]
+	auth.mutex.Unlock()
+	//bcrypt takes its time, others may look up their sessions meanwhile
+	if !inmap {
+		bcrypt.CompareHashAndPassword(dummy_hash_, []byte(password))
+		return WebUser{}, fmt.Errorf("wrong user or password")
+	}
+	if err := bcrypt.CompareHashAndPassword(entry.hash, []byte(password)); err != nil {
+		return WebUser{}, fmt.Errorf("wrong user or password")
+	}
+	return WebUser{Name: name, Role: entry.role}, nil
+}
+
+func basicAuthSum(name, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(name + ":" + password))
+}
+
+// scripts send their credentials with every request, so we remember them for a while instead of running bcrypt each time
+func (auth *WebAuth) loginBasicAuth(name, password string) (WebUser, error) {
+	sum := basicAuthSum(name, password)
+	auth.mutex.Lock()
+	cached, inmap := auth.basicauth[name]
+	auth.mutex.Unlock()
+	if inmap && time.Now().Before(cached.expires) && subtle.ConstantTimeCompare(cached.sum[:], sum[:]) == 1 {
+		return cached.user, nil
+	}
+	user, err := auth.Login(name, password)
+	if err != nil {
+		return user, err
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	now := time.Now()
+	for cachedname, cached := range auth.basicauth {
+		if now.After(cached.expires) {
+			delete(auth.basicauth, cachedname)
+		}
+	}
+	auth.basicauth[name] = basicAuthEntry{user: user, sum: sum, expires: now.Add(basic_auth_cache_lifetime_)}
+	return user, nil
+}
+
+func (auth *WebAuth) newSession(user WebUser) string {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	now := time.Now()
+	for token, session := range auth.sessions {
+		if now.After(session.expires) {
+			delete(auth.sessions, token)
+		}
+	}
+	token := newSessionToken()
+	auth.sessions[token] = &webSession{user: user, expires: now.Add(session_lifetime_)}
+	return token
+}
+
+func (auth *WebAuth) endSession(token string) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	delete(auth.sessions, token)
+}
+
+// tells who sent the request. Without valid session or proxy header that is the anonymous user
+func (auth *WebAuth) UserFor(r *http.Request) WebUser {
+	switch auth.mode {
+	case AuthProxyHeader:
+		name := r.Header.Get(auth.proxyheader)
+		if len(name) == 0 {
+			return auth.anonymous
+		}
+		if !fromTrustedProxy(r) {
+			LogAudit_.Printf("ignoring %s %s from %s, not a trusted proxy", auth.proxyheader, name, r.RemoteAddr)
+			return auth.anonymous
+		}
+		auth.mutex.Lock()
+		defer auth.mutex.Unlock()
+		if entry, inmap := auth.passwd[name]; inmap {
+			return WebUser{Name: name, Role: entry.role}
+		}
+		return WebUser{Name: name, Role: auth.anonymous.Role}
+	case AuthPasswordFile:
+		cookie, err := r.Cookie(session_cookie_name_)
+		if err != nil {
+			//scripts may send their credentials with every request instead
+			if name, password, hasbasic := r.BasicAuth(); hasbasic {
+				user, err := auth.loginBasicAuth(name, password)
+				if err == nil {
+					return user
+				}
+				LogAudit_.Printf("basic auth FAILED for %s from %s", name, r.RemoteAddr)
+			}
+			return auth.anonymous
+		}
+		auth.mutex.Lock()
+		defer auth.mutex.Unlock()
+		if session, inmap := auth.sessions[cookie.Value]; inmap && time.Now().Before(session.expires) {
+			return session.user
+		}
+	}
+	return auth.anonymous
+}
+
+// tells if r carries its own credentials, basic auth or the header of our reverse proxy, instead of a session cookie a browser would send anywhere
+func (auth *WebAuth) authenticatesEachRequest(r *http.Request) bool {
+	switch auth.mode {
+	case AuthProxyHeader:
+		return len(r.Header.Get(auth.proxyheader)) > 0 && fromTrustedProxy(r)
+	case AuthPasswordFile:
+		_, _, hasbasic := r.BasicAuth()
+		_, err := r.Cookie(session_cookie_name_)
+		return hasbasic && err != nil
+	}
+	return false
+}
+
+// the name GoLightCtrl is told a command came from, see MQTTOutboundMsg.by. Empty without login
+func (auth *WebAuth) PublishAs(user WebUser) string {
+	if auth.mode == AuthNone {
+		return ""
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(user.Name)
+}
+
+func (user WebUser) MaySend(ctx string) bool {
+	return stringInSlice(ctx, Devices().AllowedCtx(user.Role))
+}
+
+func auditLogSend(user WebUser, r *http.Request, ctx string, data interface{}, allowed bool) {
+	databytes, _ := json.Marshal(data)
+	LogAudit_.Printf("%s %s (%s) from %s: %s %s", IfThenElseStr(allowed, "sent", "DENIED"), user.Name, user.Role, r.RemoteAddr, ctx, databytes)
+}
+
+func redirectTo(w http.ResponseWriter, r *http.Request, urlStr string) {
+	http.Redirect(w, r, urlStr, http.StatusSeeOther)
+}
+
+// handles POST /login with form fields "user" and "password"
+func webHandleLogin(w http.ResponseWriter, r *http.Request, auth *WebAuth) {
+	if auth.mode != AuthPasswordFile || r.Method != "POST" {
+		redirectTo(w, r, "/login.html")
+		return
+	}
+	if !webOriginAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := auth.Login(r.PostFormValue("user"), r.PostFormValue("password"))
+	if err != nil {
+		LogAudit_.Printf("login FAILED for %s from %s", r.PostFormValue("user"), r.RemoteAddr)
+		redirectTo(w, r, "/login.html?failed=1")
+		return
+	}
+	LogAudit_.Printf("login %s (%s) from %s", user.Name, user.Role, r.RemoteAddr)
+	http.SetCookie(w, &http.Cookie{
+		Name:     session_cookie_name_,
+		Value:    auth.newSession(user),
+		Path:     "/",
+		MaxAge:   int(session_lifetime_ / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	redirectTo(w, r, "/switch.html")
+}
+
+func webHandleLogout(w http.ResponseWriter, r *http.Request, auth *WebAuth) {
+	if cookie, err := r.Cookie(session_cookie_name_); err == nil {
+		auth.endSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: session_cookie_name_, Value: "", Path: "/", MaxAge: -1})
+	redirectTo(w, r, "/switch.html")
+}
+
+// tells the web page who is logged in and what they may switch
+func webHandleWhoAmI(w http.ResponseWriter, r *http.Request, auth *WebAuth) {
+	user := auth.UserFor(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		WebUser
+		Mode    string   `json:"mode"`
+		Allowed []string `json:"allowed"`
+	}{user, auth.mode, Devices().AllowedCtx(user.Role)})
+}
+
+// reads a password from stdin and prints a line for GOMQTTWEBFRONT_PASSWORDFILE
+func PrintPasswdLine(name, role string) error {
+	if !stringInSlice(role, roles_) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	linescanner := bufio.NewScanner(os.Stdin)
+	if !linescanner.Scan() {
+		return fmt.Errorf("no password given")
+	}
+	hash, err := bcrypt.GenerateFromPassword(linescanner.Bytes(), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s:%s:%s\n", name, hash, role)
+	return nil
+}
@@ -0,0 +1,100 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/btittelbach/pubsub"
+)
+
+const ws_ctx_availability_ = "availability"
+
+// kind/name -> online, for devices that told us
+var availability_ = make(map[string]bool, 20)
+var availability_lock_ sync.RWMutex
+
+// understands h801 {"online":true}, tasmota Online/Offline and esphome online/offline
+func parseOnline(payload []byte) (online bool, ok bool) {
+	var status struct {
+		Online *bool `json:"online"`
+	}
+	if err := json.Unmarshal(payload, &status); err == nil && status.Online != nil {
+		return *status.Online, true
+	}
+	switch strings.ToLower(strings.TrimSpace(string(payload))) {
+	case "online", "true", "1":
+		return true, true
+	case "offline", "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+func updateAvailability(ps *pubsub.PubSub, devs []*DeviceConfig, payload []byte) {
+	online, ok := parseOnline(payload)
+	if !ok {
+		LogMain_.Printf("Availability: can't understand %s", payload)
+		return
+	}
+	changed := false
+	availability_lock_.Lock()
+	for _, dev := range devs {
+		if last, known := availability_[dev.Kind+"/"+dev.Name]; !known || last != online {
+			LogMain_.Printf("Availability: %s %s is %s", dev.Kind, dev.Name, IfThenElseStr(online, "online", "offline"))
+			availability_[dev.Kind+"/"+dev.Name] = online
+			changed = true
+		}
+	}
+	availability_lock_.Unlock()
+	if changed {
+		publishAvailability(ps)
+	}
+}
+
+// state and command topics of every device we know the online status of -> online
+func availabilityMap() map[string]bool {
+	availability_lock_.RLock()
+	defer availability_lock_.RUnlock()
+	reg := Devices()
+	topics := make(map[string]bool, 2*len(availability_))
+	for _, dev := range reg.devices {
+		online, known := availability_[dev.Kind+"/"+dev.Name]
+		if !known {
+			continue
+		}
+		for _, topic := range []string{dev.StateTopic, dev.CommandTopic} {
+			if len(topic) > 0 {
+				topics[topic] = online
+			}
+		}
+	}
+	return topics
+}
+
+// the whole map every time, so clients only need the last one
+func publishAvailability(ps *pubsub.PubSub) {
+	ps.Pub(wsMessage{Ctx: ws_ctx_availability_, Data: availabilityMap()}, PS_WEBSOCK_ALL)
+}
+
+// commands to a device that told us it is offline go nowhere
+func CheckDeviceOnline(ctx string) error {
+	dev, inmap := Devices().ByTopic(ctx)
+	if !inmap {
+		return nil
+	}
+	if online, known := DeviceOnline(dev); known && !online {
+		return fmt.Errorf("%s is offline", dev.Name)
+	}
+	return nil
+}
+
+// known is false for devices that never told us
+func DeviceOnline(dev *DeviceConfig) (online bool, known bool) {
+	availability_lock_.RLock()
+	defer availability_lock_.RUnlock()
+	online, known = availability_[dev.Kind+"/"+dev.Name]
+	return
+}
@@ -2,17 +2,20 @@
 package main
 
 const (
-	PS_WEBSOCK_ALL_JSON   = "websock_toall_json"
 	PS_WEBSOCK_ALL        = "websock_toall"
 	PS_LIGHTS_CHANGED     = "light_state_changed"
 	PS_IRRF433_CHANGED    = "stateless_button_send_event"
 	PS_FANCYLIGHT_CHANGED = "fancylight_update"
 	PS_LEDPIPE_CHANGED    = "ledpipe_update"
+	PS_DEVICES_CHANGED    = "devices_changed"
 	PS_SHUTDOWN           = "shutdown"
 	PS_SHUTDOWN_CONSUMER  = "shutdownindiscriminateconsumer"
 )
 
 var MQTT_sendmsg_chan_ chan MQTTOutboundMsg
+var follow_dawndusk_chan_ chan dawnDuskFollower
+var ha_discovery_chan_ chan haDiscoveredDevice
+var statecache_save_chan_ chan chan error
 
 // var switch_name_chan_ chan r3events.LightCtrlActionOnName
 // var MQTT_ir_chan_ chan string
@@ -23,6 +26,9 @@ var MQTT_sendmsg_chan_ chan MQTTOutboundMsg
 
 func init() {
 	MQTT_sendmsg_chan_ = make(chan MQTTOutboundMsg, 50)
+	follow_dawndusk_chan_ = make(chan dawnDuskFollower, 10)
+	ha_discovery_chan_ = make(chan haDiscoveredDevice, 50)
+	statecache_save_chan_ = make(chan chan error)
 	// switch_name_chan_ = make(chan r3events.LightCtrlActionOnName, 50)
 	// RF433_linearize_chan_ = make(chan RFCmdToSend, 10)
 	// MQTT_ir_chan_ = make(chan string, 10)
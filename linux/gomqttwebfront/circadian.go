@@ -0,0 +1,227 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/btittelbach/pubsub"
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	follow_dawndusk_interval_          = time.Minute
+	DEFAULT_CIRCADIAN_WINTENSITY int64 = 800
+)
+
+// Lights listed in the file follow the sun from startup on, like the redshift script in scriptctrl.
+// e.g. {"Lights":["ceiling1","ceiling2"], "WIntensity":800, "Fade":"1m", "ResumeAfter":"4h"}
+func LoadCircadianConfig(filename string) (*CircadianConfig, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	config := &CircadianConfig{WIntensity: DEFAULT_CIRCADIAN_WINTENSITY}
+	if err := json.NewDecoder(fh).Decode(config); err != nil {
+		return nil, err
+	}
+	if err := checkRange("WIntensity", &config.WIntensity, 0, 1000); err != nil {
+		return nil, err
+	}
+	config.fade = follow_dawndusk_interval_
+	if len(config.Fade) > 0 {
+		if config.fade, err = time.ParseDuration(config.Fade); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.ResumeAfter) > 0 {
+		if config.resumeafter, err = time.ParseDuration(config.ResumeAfter); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range config.Lights {
+		if dev, inmap := Devices().Lookup(DeviceFancy, name); !inmap || len(dev.Members) > 0 {
+			return nil, fmt.Errorf("%s is not a fancy light", name)
+		}
+	}
+	return config, nil
+}
+
+func fancyLightTopic(name string) string {
+	if dev, inmap := Devices().Lookup(DeviceFancy, name); inmap && len(dev.CommandTopic) > 0 {
+		return dev.CommandTopic
+	}
+	return r3events.TOPIC_ACTIONS + name + "/" + r3events.TYPE_LIGHT
+}
+
+func fancyLightName(topic string) string {
+	if dev, inmap := Devices().ByTopic(topic); inmap && dev.Kind == DeviceFancy {
+		return dev.Name
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(topic, r3events.TOPIC_ACTIONS), "/"+r3events.TYPE_LIGHT)
+}
+
+// that name now follows the sun, or that somebody set it to something else.
+// expect is what is sent to the light, so we don't take it for a manual change once we see it on MQTT
+func newDawnDuskFollower(name string, adv *AdvFancyLightSettings, expect r3events.FancyLight) dawnDuskFollower {
+	follow := adv != nil && adv.FollowDawnDusk != nil && *adv.FollowDawnDusk
+	following := dawnDuskFollower{name: name, follow: follow, expect: expect}
+	if follow {
+		following.setting = *adv
+	}
+	return following
+}
+
+// tell goFollowDawnDusk about a command that was published
+func followDawnDusk(following dawnDuskFollower) {
+	select {
+	case follow_dawndusk_chan_ <- following:
+	default:
+		LogMain_.Printf("followDawnDusk: dropping update for %s", following.name)
+	}
+}
+
+// missing values count as 0
+func uint16Equals(a *uint16, b interface{}) bool {
+	var av, bv float64
+	if a != nil {
+		av = float64(*a)
+	}
+	if b != nil {
+		f, isnumber := b.(float64)
+		if !isnumber {
+			return false
+		}
+		bv = f
+	}
+	return av == bv
+}
+
+// tells if a light setting seen on MQTT has the same led values as fl
+func sameLEDs(fl r3events.FancyLight, data interface{}) bool {
+	obj, isobj := data.(map[string]interface{})
+	if !isobj {
+		return false
+	}
+	return uint16Equals(fl.R, obj["r"]) && uint16Equals(fl.G, obj["g"]) && uint16Equals(fl.B, obj["b"]) && uint16Equals(fl.WW, obj["ww"]) && uint16Equals(fl.CW, obj["cw"])
+}
+
+// names of the lights a setting on ctx changes
+func fancyLightNamesOf(ctx string) []string {
+	reg := Devices()
+	dev, inmap := reg.ByTopic(ctx)
+	if !inmap || dev.Kind != DeviceFancy {
+		return nil
+	}
+	if len(dev.Members) == 0 {
+		return []string{dev.Name}
+	}
+	names := make([]string, 0, len(dev.Members))
+	for _, member := range dev.Members {
+		if mdev, inmap := reg.ByTopic(member); inmap {
+			names = append(names, mdev.Name)
+		}
+	}
+	return names
+}
+
+func (f *dawnDuskFollowing) sendUpdate(name string, fade time.Duration) {
+	fl := ConvertAdvFancyLightSettings(name, &f.setting)
+	f.expect = fl
+	if fade > 0 {
+		fl.Fade = &struct {
+			Duration uint32   `json:"duration,omitempty"`
+			Cc       []string `json:"cc,omitempty"`
+		}{Duration: uint32(fade / time.Millisecond)}
+	}
+	select {
+	case MQTT_sendmsg_chan_ <- MQTTOutboundMsg{topic: fancyLightTopic(name), msg: fl}:
+	default:
+		LogMain_.Printf("FollowDawnDusk: dropping update for %s", name)
+	}
+}
+
+// Regularly fades lights that follow dawn and dusk to the white balance matching the sun.
+// Lights opted in via circadian config are suspended, not forgotten, once somebody sets them to something else
+// and resume after ResumeAfter or when told to follow again.
+func goFollowDawnDusk(ps *pubsub.PubSub, circadian *CircadianConfig) {
+	shutdown_c := ps.SubOnce(PS_SHUTDOWN)
+	lightstate_c := ps.Sub(PS_WEBSOCK_ALL)
+	defer ps.Unsub(lightstate_c, PS_WEBSOCK_ALL)
+	ticker := time.NewTicker(follow_dawndusk_interval_)
+	defer ticker.Stop()
+	fade := follow_dawndusk_interval_
+	followers := make(map[string]*dawnDuskFollowing, 8)
+	if circadian != nil {
+		fade = circadian.fade
+		follow := true
+		for _, name := range circadian.Lights {
+			intensity := circadian.WIntensity
+			followers[name] = &dawnDuskFollowing{optedin: true, setting: AdvFancyLightSettings{FollowDawnDusk: &follow, WIntensity: &intensity}}
+			LogMain_.Printf("FollowDawnDusk: %s follows the sun", name)
+		}
+	}
+	stopFollowing := func(name, why string) {
+		f, inmap := followers[name]
+		if !inmap || !f.suspended.IsZero() {
+			return
+		}
+		if f.optedin {
+			LogMain_.Printf("FollowDawnDusk: %s suspended, %s", name, why)
+			f.suspended = time.Now()
+		} else {
+			LogMain_.Printf("FollowDawnDusk: %s stopped following the sun, %s", name, why)
+			delete(followers, name)
+		}
+	}
+	for {
+		select {
+		case <-shutdown_c:
+			return
+		case f := <-follow_dawndusk_chan_:
+			if !f.follow {
+				stopFollowing(f.name, "set by web client")
+				continue
+			}
+			following, inmap := followers[f.name]
+			if !inmap {
+				following = &dawnDuskFollowing{}
+				followers[f.name] = following
+			}
+			if !inmap || !following.suspended.IsZero() {
+				LogMain_.Printf("FollowDawnDusk: %s now follows the sun", f.name)
+			}
+			following.setting, following.expect, following.suspended = f.setting, f.expect, time.Time{}
+		case webmsg_i, isopen := <-lightstate_c:
+			if !isopen {
+				lightstate_c = ps.Sub(PS_WEBSOCK_ALL)
+				continue
+			}
+			webmsg, castok := webmsg_i.(wsMessage)
+			if !castok {
+				continue
+			}
+			for _, name := range fancyLightNamesOf(webmsg.Ctx) {
+				//until we sent something, whatever the light reports is not a manual change
+				if f, inmap := followers[name]; inmap && f.suspended.IsZero() && f.expect.R != nil && !sameLEDs(f.expect, webmsg.Data) {
+					stopFollowing(name, "set manually via "+webmsg.Ctx)
+				}
+			}
+		case now := <-ticker.C:
+			for name, f := range followers {
+				if !f.suspended.IsZero() {
+					if circadian == nil || circadian.resumeafter <= 0 || now.Sub(f.suspended) < circadian.resumeafter {
+						continue
+					}
+					LogMain_.Printf("FollowDawnDusk: %s resumes following the sun", name)
+					f.suspended = time.Time{}
+				}
+				f.sendUpdate(name, fade)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	web_command_queue_max_                = 50 // different ctx waiting at once, as many as MQTT_sendmsg_chan_ holds
+	DEFAULT_GOMQTTWEBFRONT_WSCMDLIMIT     = "50/10s"
+	DEFAULT_GOMQTTWEBFRONT_DEVICECMDLIMIT = "10/1s"
+)
+
+var (
+	errCommandSuperseded = fmt.Errorf("superseded by a newer command for the same ctx")
+	errCommandQueueFull  = fmt.Errorf("too many commands waiting, try again later")
+	errCommandRateLimit  = fmt.Errorf("too many commands, slow down")
+	errShuttingDown      = fmt.Errorf("shutting down")
+)
+
+var (
+	web_commands_     = newWebCommandQueue()
+	ws_command_limit_ rateLimit //per websocket connection, GOMQTTWEBFRONT_WSCMDLIMIT
+)
+
+func newWebCommandQueue() *webCommandQueue {
+	return &webCommandQueue{
+		pending: make(map[string]MQTTOutboundMsg, web_command_queue_max_),
+		buckets: make(map[string]*tokenBucket, 50),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Queues msg without blocking. If a command for the same ctx is still waiting, e.g. while somebody drags
+// a color picker, only the newest is sent and the older one told it was superseded
+func (q *webCommandQueue) enqueue(msg MQTTOutboundMsg) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return errShuttingDown
+	}
+	old, waiting := q.pending[msg.topic]
+	if !waiting {
+		if len(q.order) >= web_command_queue_max_ {
+			q.mutex.Unlock()
+			return errCommandQueueFull
+		}
+		q.order = append(q.order, msg.topic)
+	}
+	q.pending[msg.topic] = msg
+	q.mutex.Unlock()
+	if waiting {
+		old.published(errCommandSuperseded)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// takes the commands whose ctx may send now and tells how long until the next of the others may, -1 if none are left
+func (q *webCommandQueue) takeReady(now time.Time, ignorelimit bool) ([]MQTTOutboundMsg, time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var ready []MQTTOutboundMsg
+	wait := time.Duration(-1)
+	remaining := q.order[:0]
+	for _, ctx := range q.order {
+		bucket, inmap := q.buckets[ctx]
+		if !inmap {
+			bucket = newTokenBucket(q.limit, now)
+			q.buckets[ctx] = bucket
+		}
+		if ok, after := bucket.take(now, q.limit); ok || ignorelimit {
+			ready = append(ready, q.pending[ctx])
+			delete(q.pending, ctx)
+		} else {
+			remaining = append(remaining, ctx)
+			if wait < 0 || after < wait {
+				wait = after
+			}
+		}
+	}
+	q.order = remaining
+	return ready, wait
+}
+
+// Hands queued commands to outmsg_chan as fast as their ctx may send.
+// Once ctx is done, refuses new ones and hands over what is left regardless of limits
+func (q *webCommandQueue) goForward(ctx context.Context, outmsg_chan chan MQTTOutboundMsg) {
+	var later <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			q.mutex.Lock()
+			q.closed = true
+			q.mutex.Unlock()
+			ready, _ := q.takeReady(time.Now(), true)
+			forwardWithoutWaiting(outmsg_chan, ready)
+			return
+		case <-q.notify:
+		case <-later:
+		}
+		ready, wait := q.takeReady(time.Now(), false)
+	FORWARD:
+		for idx, msg := range ready {
+			select {
+			case outmsg_chan <- msg: //while this blocks, newer commands replace the waiting ones
+			case <-ctx.Done():
+				forwardWithoutWaiting(outmsg_chan, ready[idx:])
+				break FORWARD
+			}
+		}
+		later = nil
+		if wait >= 0 {
+			later = time.After(wait)
+		}
+	}
+}
+
+// on shutdown whoever publishes may be gone already. Commands that don't fit are failed, so callers still get an answer
+func forwardWithoutWaiting(outmsg_chan chan MQTTOutboundMsg, msgs []MQTTOutboundMsg) {
+	for _, msg := range msgs {
+		select {
+		case outmsg_chan <- msg:
+		default:
+			msg.published(errShuttingDown)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func readyTopicsAndMsgs(ready []MQTTOutboundMsg) string {
+	s := ""
+	for _, msg := range ready {
+		s += fmt.Sprintf("%s=%v ", msg.topic, msg.msg)
+	}
+	return s
+}
+
+func TestWebCommandQueueCoalesces(t *testing.T) {
+	q := newWebCommandQueue()
+	var superseded []error
+	for _, msg := range []MQTTOutboundMsg{
+		{topic: "action/ceiling1/light", msg: 1, onpublished: func(err error) { superseded = append(superseded, err) }},
+		{topic: "action/ceiling2/light", msg: 1},
+		{topic: "action/ceiling1/light", msg: 2},
+	} {
+		if err := q.enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(superseded) != 1 || superseded[0] != errCommandSuperseded {
+		t.Errorf("older command for the same ctx was told %v, want %v", superseded, errCommandSuperseded)
+	}
+	ready, wait := q.takeReady(time.Now(), false)
+	//ceiling1 keeps the place in line of its first command
+	if got, want := readyTopicsAndMsgs(ready), "action/ceiling1/light=2 action/ceiling2/light=1 "; got != want {
+		t.Errorf("takeReady = %s, want %s", got, want)
+	}
+	if wait >= 0 || len(q.pending) > 0 || len(q.order) > 0 {
+		t.Errorf("queue not empty after taking everything: wait %s, %d pending", wait, len(q.pending))
+	}
+}
+
+func TestWebCommandQueueFull(t *testing.T) {
+	q := newWebCommandQueue()
+	for idx := 0; idx < web_command_queue_max_; idx++ {
+		if err := q.enqueue(MQTTOutboundMsg{topic: fmt.Sprintf("action/light%d/light", idx), msg: idx}); err != nil {
+			t.Fatalf("command %d: %s", idx, err)
+		}
+	}
+	if err := q.enqueue(MQTTOutboundMsg{topic: "action/onetoomany/light", msg: 1}); err != errCommandQueueFull {
+		t.Errorf("command for one ctx too many: %v, want %v", err, errCommandQueueFull)
+	}
+	if err := q.enqueue(MQTTOutboundMsg{topic: "action/light0/light", msg: 2}); err != nil {
+		t.Errorf("newer command for a waiting ctx must replace it even if the queue is full: %s", err)
+	}
+}
+
+func TestWebCommandQueueRateLimitsPerCtx(t *testing.T) {
+	q := newWebCommandQueue()
+	q.limit = rateLimit{rate: 1, burst: 1}
+	now := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		enqueue     []string
+		after       time.Duration
+		ignorelimit bool
+		ready       string
+		wait        time.Duration
+	}{
+		{[]string{"a", "b"}, 0, false, "a=0 b=0 ", -1},
+		{[]string{"a"}, 0, false, "", time.Second},
+		{[]string{"b"}, 500 * time.Millisecond, false, "", 500 * time.Millisecond},
+		{nil, time.Second, false, "a=0 b=0 ", -1},
+		{[]string{"a"}, time.Second, true, "a=0 ", -1},
+	} {
+		for _, topic := range tc.enqueue {
+			if err := q.enqueue(MQTTOutboundMsg{topic: topic, msg: 0}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ready, wait := q.takeReady(now.Add(tc.after), tc.ignorelimit)
+		if got := readyTopicsAndMsgs(ready); got != tc.ready || wait != tc.wait {
+			t.Errorf("after %s enqueueing %v: takeReady = %q, %s, want %q, %s", tc.after, tc.enqueue, got, wait, tc.ready, tc.wait)
+		}
+	}
+}
+
+func TestWebCommandQueueFlushesOnShutdown(t *testing.T) {
+	q := newWebCommandQueue()
+	q.limit = rateLimit{rate: 1.0 / 3600, burst: 1}
+	out := make(chan MQTTOutboundMsg, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.goForward(ctx, out)
+		close(done)
+	}()
+	q.enqueue(MQTTOutboundMsg{topic: "a", msg: 1})
+	if msg := <-out; msg.msg != 1 {
+		t.Fatalf("forwarded %v, want 1", msg.msg)
+	}
+	q.enqueue(MQTTOutboundMsg{topic: "a", msg: 2})
+	select {
+	case msg := <-out:
+		t.Fatalf("forwarded %v although a may only send once an hour", msg.msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	<-done
+	if len(out) != 1 {
+		t.Fatalf("%d commands forwarded on shutdown, want the 1 still waiting", len(out))
+	}
+	if err := q.enqueue(MQTTOutboundMsg{topic: "b", msg: 3}); err != errShuttingDown {
+		t.Errorf("enqueue after shutdown: %v, want %v", err, errShuttingDown)
+	}
+}
+
+func TestWebCommandQueueShutdownDoesNotWaitForPublisher(t *testing.T) {
+	q := newWebCommandQueue()
+	out := make(chan MQTTOutboundMsg) //nobody publishes anymore
+	ctx, cancel := context.WithCancel(context.Background())
+	answers := make(chan error, 2)
+	for _, topic := range []string{"a", "b"} {
+		q.enqueue(MQTTOutboundMsg{topic: topic, msg: 1, onpublished: func(err error) { answers <- err }})
+	}
+	done := make(chan struct{})
+	go func() {
+		q.goForward(ctx, out)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond) //goForward now waits for out with a
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("goForward still waiting for the publisher after shutdown")
+	}
+	for idx := 0; idx < 2; idx++ {
+		if err := <-answers; err != errShuttingDown {
+			t.Errorf("waiting command told %v, want %v", err, errShuttingDown)
+		}
+	}
+}
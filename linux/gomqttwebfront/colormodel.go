@@ -0,0 +1,150 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const color_model_default_name_ = "_default_"
+
+// same calibration as r3_led_factors_ in public/mqtt.js
+var color_model_ = map[string]LEDFactors{
+	color_model_default_name_: {R: 1, G: 5, B: 10, WW: 22, CW: 18}, //green 5 times, blue 10 times, warmwhite 22 times as bright as red
+	"flooddoor":               {R: 4, G: 4, B: 4, WW: 12, CW: 12},
+	"abwasch":                 {R: 4, G: 4, B: 4, WW: 12, CW: 12},
+	"funkbude":                {R: 4, G: 4, B: 4, WW: 12, CW: 12},
+}
+
+// names in the file replace or add to the built-in calibration
+func LoadColorModel(filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	model := make(map[string]LEDFactors, 10)
+	if err := json.NewDecoder(fh).Decode(&model); err != nil {
+		return err
+	}
+	for name, factors := range model {
+		if factors.R <= 0 || factors.G <= 0 || factors.B <= 0 || factors.WW <= 0 || factors.CW <= 0 {
+			LogMain_.Printf("LoadColorModel: ignoring %s, factors must be > 0", name)
+			continue
+		}
+		color_model_[name] = factors
+	}
+	return nil
+}
+
+func ledFactorsFor(name string) LEDFactors {
+	if factors, inmap := color_model_[name]; inmap {
+		return factors
+	}
+	return color_model_[color_model_default_name_]
+}
+
+// same hue ranges as hsv2rgb in public/colorandtemppicker.js. Returns r,g,b in [0..1.0]
+func hsv2rgb(hsv HSV) (float64, float64, float64) {
+	h, s, v := hsv.H, hsv.S, hsv.V
+	var f float64
+	var hrange int
+	switch {
+	case h > 0.835:
+		hrange, f = 5, (h-0.835)/(1-0.835)
+	case h > 0.665:
+		hrange, f = 4, (h-0.665)/(0.835-0.665)
+	case h > 0.470:
+		hrange, f = 3, (h-0.470)/(0.665-0.470)
+	case h > 0.333:
+		hrange, f = 2, (h-0.333)/(0.470-0.333)
+	case h > 0.166:
+		hrange, f = 1, (h-0.166)/(0.333-0.166)
+	default:
+		hrange, f = 0, h/0.166
+	}
+	p := v * (1 - s)
+	q := v * (1 - f*s)
+	t := v * (1 - (1-f)*s)
+	switch hrange {
+	case 0:
+		return v, t, p
+	case 1:
+		return q, v, p
+	case 2:
+		return p, v, t
+	case 3:
+		return p, q, v
+	case 4:
+		return t, p, v
+	}
+	return v, p, q
+}
+
+// compensates the different brightness of the leds, keeping the brightness of the color as given
+// like calcCeilingValuesFrom in public/mqtt.js. Returns r,g,b in [0..1000]
+func rgbToLEDs(name string, r, g, b float64) (float64, float64, float64) {
+	magn_orig := math.Sqrt(r*r + g*g + b*b)
+	if magn_orig == 0 {
+		return 0, 0, 0
+	}
+	factors := ledFactorsFor(name)
+	r, g, b = r/factors.R, g/factors.G, b/factors.B
+	scale := magn_orig / math.Sqrt(r*r+g*g+b*b)
+	r, g, b = r*scale, g*scale, b*scale
+	//fit into 1.0 by 1.0 by 1.0 box
+	fitting := math.Max(1.0, math.Max(r, math.Max(g, b)))
+	return r * 1000 / fitting, g * 1000 / fitting, b * 1000 / fitting
+}
+
+// like calcColorFromDayLevel in public/mqtt.js: balance -500 is reddish warm, 0 warmwhite, 500 coldwhite
+// Returns r,ww,cw in [0..1000]
+func whiteToLEDs(name string, intensity, balance int64) (float64, float64, float64) {
+	factors := ledFactorsFor(name)
+	day_factor := math.Min(1.0, math.Max(-1.0, float64(balance)/500.0))
+	value := float64(intensity) / 1000.0
+	r := 1000 * value * math.Max(0.0, -1.0*day_factor)
+	cw := 1000 * value * math.Max(0.0, day_factor)
+	ww := math.Max(0, 1000*value-cw-r/3)
+	//coldwhite leds are darker than warmwhite, so give them more to keep the intensity
+	cw = cw * factors.WW / factors.CW
+	return r, ww, cw
+}
+
+func clampLED(value float64) *uint16 {
+	v := uint16(math.Round(math.Min(1000, math.Max(0, value))))
+	return &v
+}
+
+// converts advanced settings into what the light understands.
+// HSV and white are added up, balance is taken from the sun if the light follows dawn and dusk
+func ConvertAdvFancyLightSettings(name string, adv *AdvFancyLightSettings) r3events.FancyLight {
+	var r, g, b, ww, cw float64
+	if adv.HSV != nil {
+		hr, hg, hb := hsv2rgb(*adv.HSV)
+		r, g, b = rgbToLEDs(name, hr, hg, hb)
+	}
+	if adv.WIntensity != nil || adv.WBalance != nil || (adv.FollowDawnDusk != nil && *adv.FollowDawnDusk) {
+		intensity, balance := int64(1000), int64(0)
+		if adv.WIntensity != nil {
+			intensity = *adv.WIntensity
+		}
+		if adv.WBalance != nil {
+			balance = *adv.WBalance
+		}
+		if adv.FollowDawnDusk != nil && *adv.FollowDawnDusk {
+			balance = WBalanceFromSun(time.Now())
+		}
+		wr, wwww, wcw := whiteToLEDs(name, intensity, balance)
+		r, ww, cw = r+wr, ww+wwww, cw+wcw
+	}
+	return r3events.FancyLight{R: clampLED(r), G: clampLED(g), B: clampLED(b), WW: clampLED(ww), CW: clampLED(cw)}
+}
+
+func (adv *AdvFancyLightSettings) isSet() bool {
+	return adv.HSV != nil || adv.WIntensity != nil || adv.WBalance != nil || adv.FollowDawnDusk != nil
+}
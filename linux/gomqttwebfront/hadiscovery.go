@@ -0,0 +1,153 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const ha_discovery_settle_time_ = 2 * time.Second
+
+// abbreviations Home Assistant allows in discovery configs, as far as we use them
+var ha_abbreviations_ = map[string]string{
+	"stat_t":   "state_topic",
+	"cmd_t":    "command_topic",
+	"uniq_id":  "unique_id",
+	"pl_on":    "payload_on",
+	"pl_off":   "payload_off",
+	"bri_scl":  "brightness_scale",
+	"sup_clrm": "supported_color_modes",
+	"min_mirs": "min_mireds",
+	"max_mirs": "max_mireds",
+}
+
+// <prefix>/<component>/[<node_id>/]<object_id>/config
+func subscribeHADiscovery(mqttc mqtt.Client, prefix string) {
+	callback := func(c mqtt.Client, msg mqtt.Message) {
+		var d haDiscoveredDevice
+		d.topic = msg.Topic()
+		if len(msg.Payload()) > 0 {
+			dev, err := parseHADiscovery(prefix, msg.Topic(), msg.Payload())
+			if err != nil {
+				LogMain_.Printf("HADiscovery: ignoring %s: %s", msg.Topic(), err)
+				return
+			}
+			if dev == nil {
+				return //nothing we can switch
+			}
+			d.device = dev
+		}
+		ha_discovery_chan_ <- d //don't drop, a lost removal would leave a ghost device
+	}
+	SubscribeAndAttachCallback(mqttc, prefix+"/+/+/config", callback)
+	SubscribeAndAttachCallback(mqttc, prefix+"/+/+/+/config", callback)
+}
+
+// expands abbreviated keys and the ~ base topic
+func expandHADiscoveryConfig(payload []byte) (*haDiscoveryConfig, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	base, _ := raw["~"].(string)
+	expanded := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if full, inmap := ha_abbreviations_[key]; inmap {
+			key = full
+		}
+		if str, isstring := value.(string); isstring && len(base) > 0 && strings.HasSuffix(key, "_topic") {
+			if strings.HasPrefix(str, "~") {
+				str = base + str[1:]
+			} else if strings.HasSuffix(str, "~") {
+				str = str[:len(str)-1] + base
+			}
+			value = str
+		}
+		expanded[key] = value
+	}
+	jsonbytes, err := json.Marshal(expanded)
+	if err != nil {
+		return nil, err
+	}
+	var config haDiscoveryConfig
+	if err := json.Unmarshal(jsonbytes, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// turns a discovery config into a device, nil for components we can't switch
+func parseHADiscovery(prefix, topic string, payload []byte) (*DeviceConfig, error) {
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("unexpected topic")
+	}
+	component := parts[0]
+	if component != "switch" && component != "light" {
+		return nil, nil
+	}
+	config, err := expandHADiscoveryConfig(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.CommandTopic) == 0 {
+		return nil, fmt.Errorf("no command_topic")
+	}
+	dev := &DeviceConfig{
+		Name:          config.UniqueId,
+		Kind:          DeviceHASwitch,
+		StateTopic:    config.StateTopic,
+		CommandTopic:  config.CommandTopic,
+		SendOnConnect: len(config.StateTopic) > 0,
+		Discovery:     topic,
+		PayloadOn:     config.PayloadOn,
+		PayloadOff:    config.PayloadOff,
+	}
+	if len(dev.Name) == 0 {
+		dev.Name = strings.Join(parts[1:len(parts)-1], "_")
+	}
+	for _, t := range []string{dev.StateTopic, dev.CommandTopic} {
+		if err := checkTopic(t); len(t) > 0 && err != nil {
+			return nil, err
+		}
+	}
+	//lights with json schema tell us what they can do, others we only switch on and off
+	if component == "light" {
+		dev.Guest = true
+		if config.Schema == "json" {
+			dev.Kind = DeviceHALight
+			dev.BrightnessScale, dev.MinMireds, dev.MaxMireds = config.BrightnessScale, config.MinMireds, config.MaxMireds
+			dev.Capabilities = haLightCapabilities(config)
+		}
+	}
+	return dev, nil
+}
+
+func haLightCapabilities(config *haDiscoveryConfig) []string {
+	var brightness, color, colortemp = config.Brightness, config.RGB, config.ColorTemp
+	for _, mode := range config.SupportedColorModes {
+		switch mode {
+		case "brightness", "white":
+			brightness = true
+		case "color_temp":
+			brightness, colortemp = true, true
+		case "rgb", "rgbw", "rgbww", "hs", "xy":
+			brightness, color = true, true
+		}
+	}
+	var capabilities []string
+	if brightness {
+		capabilities = append(capabilities, "brightness")
+	}
+	if color {
+		capabilities = append(capabilities, "color")
+	}
+	if colortemp {
+		capabilities = append(capabilities, "color_temp")
+	}
+	return capabilities
+}
@@ -0,0 +1,214 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tls_cert_check_interval_  = 30 * time.Second
+	systemd_listen_fds_start_ = 3
+	systemd_listen_prefix_    = "systemd"
+)
+
+// Sockets systemd passed us with socket activation, by FileDescriptorName.
+// All of them are also found under systemd_listen_prefix_
+func systemdListeners() (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener, 2)
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %s", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	//don't hand them down to anything we might start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for i := 0; i < nfds; i++ {
+		name := "unknown"
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemd_listen_fds_start_+i), name)
+		l, err := net.FileListener(f)
+		f.Close() //FileListener made its own copy
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d (%s): %s", i, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+		listeners[systemd_listen_prefix_] = append(listeners[systemd_listen_prefix_], l)
+	}
+	return listeners, nil
+}
+
+// Opens the comma separated interfaces in spec, e.g. ":80,192.168.33.1:8080,systemd:http".
+// systemd:name takes the sockets systemd passed us named name, systemd alone takes all of them
+func openWebListeners(spec string, mode int, systemd map[string][]net.Listener) ([]webListener, error) {
+	var listeners []webListener
+	for _, addr := range strings.Split(spec, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		if addr == systemd_listen_prefix_ || strings.HasPrefix(addr, systemd_listen_prefix_+":") {
+			name := strings.TrimPrefix(strings.TrimPrefix(addr, systemd_listen_prefix_), ":")
+			if len(name) == 0 {
+				name = systemd_listen_prefix_
+			}
+			if len(systemd[name]) == 0 {
+				return nil, fmt.Errorf("%s: systemd passed us no such socket", addr)
+			}
+			for _, l := range systemd[name] {
+				listeners = append(listeners, webListener{listener: l, mode: mode})
+			}
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, webListener{listener: l, mode: mode})
+	}
+	return listeners, nil
+}
+
+// Everything we serve on, from GOMQTTWEBFRONT_HTTP_INTERFACE, GOMQTTWEBFRONT_HTTPS_INTERFACE and GOMQTTWEBFRONT_REDIRECT_INTERFACE.
+// Without any of them we serve plain HTTP on the sockets systemd passed us or on DEFAULT_GOMQTTWEBFRONT_HTTP_INTERFACE
+func webListenersFromEnviron() ([]webListener, error) {
+	systemd, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	httpspec := os.Getenv("GOMQTTWEBFRONT_HTTP_INTERFACE")
+	httpsspec := os.Getenv("GOMQTTWEBFRONT_HTTPS_INTERFACE")
+	redirectspec := os.Getenv("GOMQTTWEBFRONT_REDIRECT_INTERFACE")
+	if len(httpspec) == 0 && len(httpsspec) == 0 && len(redirectspec) == 0 {
+		httpspec = IfThenElseStr(len(systemd) > 0, systemd_listen_prefix_, DEFAULT_GOMQTTWEBFRONT_HTTP_INTERFACE)
+	}
+	var listeners []webListener
+	for mode, spec := range []string{webServePlain: httpspec, webServeTLS: httpsspec, webServeRedirect: redirectspec} {
+		opened, err := openWebListeners(spec, mode, systemd)
+		if err != nil {
+			for _, wl := range listeners {
+				wl.listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, opened...)
+	}
+	return listeners, nil
+}
+
+// the port we tell redirected clients to use, that of the first TLS listener. Empty for the default 443
+func webHTTPSPort(listeners []webListener) string {
+	for _, wl := range listeners {
+		if wl.mode != webServeTLS {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(wl.listener.Addr().String()); err == nil && port != "443" {
+			return port
+		}
+		break
+	}
+	return ""
+}
+
+func webRedirectToHTTPS(httpsport string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if len(httpsport) > 0 {
+			host = net.JoinHostPort(host, httpsport)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		//308 so PUT and POST to the REST API stay what they are
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
+
+// tells browsers to only ever come back with https, if GOMQTTWEBFRONT_HSTS gives a max-age like 8760h
+func webWithHSTS(next http.Handler, maxage time.Duration) http.Handler {
+	if maxage <= 0 {
+		return next
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxage/time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newTLSCertReloader(certfile, keyfile string) (*tlsCertReloader, error) {
+	if len(certfile) == 0 || len(keyfile) == 0 {
+		return nil, fmt.Errorf("GOMQTTWEBFRONT_TLSCERT and GOMQTTWEBFRONT_TLSKEY are needed for https")
+	}
+	reloader := &tlsCertReloader{certfile: certfile, keyfile: keyfile}
+	if _, err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// loads the certificate again if either file changed since we last looked. Keeps the old one if the new files are broken
+func (c *tlsCertReloader) reloadIfChanged() (bool, error) {
+	certmtime, err := getFileMTime(c.certfile)
+	if err != nil {
+		return false, err
+	}
+	keymtime, err := getFileMTime(c.keyfile)
+	if err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cert != nil && certmtime == c.certmtime && keymtime == c.keymtime {
+		return false, nil
+	}
+	//don't complain again until one of them changes, e.g. the key arriving after the cert
+	c.certmtime, c.keymtime = certmtime, keymtime
+	cert, err := tls.LoadX509KeyPair(c.certfile, c.keyfile)
+	if err != nil {
+		return false, err
+	}
+	c.cert = &cert
+	return true, nil
+}
+
+func (c *tlsCertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+func (c *tlsCertReloader) goWatch(ctx context.Context) {
+	ticker := time.NewTicker(tls_cert_check_interval_)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.reloadIfChanged()
+			if err != nil {
+				LogMain_.Printf("TLS: keeping old certificate, %s", err)
+			} else if reloaded {
+				LogMain_.Printf("TLS: loaded new certificate from %s", c.certfile)
+			}
+		}
+	}
+}
@@ -16,6 +16,7 @@ var (
 	LogRF433_ *log.Logger
 	LogMQTT_  *log.Logger
 	LogBTN_   *log.Logger
+	LogAudit_ *log.Logger
 )
 
 func init() {
@@ -25,6 +26,7 @@ func init() {
 	LogRF433_ = log.New(&NullWriter{}, "", 0)
 	LogMQTT_ = log.New(&NullWriter{}, "", 0)
 	LogBTN_ = log.New(&NullWriter{}, "", 0)
+	LogAudit_ = log.New(&NullWriter{}, "", 0)
 }
 
 func LogEnable(logtypes ...string) {
@@ -42,6 +44,8 @@ func LogEnable(logtypes ...string) {
 			LogMQTT_ = log.New(os.Stderr, "MQTT"+" ", log.LstdFlags)
 		case "BTN":
 			LogBTN_ = log.New(os.Stderr, "BTN"+" ", log.LstdFlags)
+		case "AUDIT":
+			LogAudit_ = log.New(os.Stderr, "AUDIT"+" ", log.LstdFlags)
 		case "ALL":
 			LogGPIO_ = log.New(os.Stderr, "GPIO ", log.LstdFlags)
 			LogMain_ = log.New(os.Stderr, "MAIN"+" ", log.LstdFlags)
@@ -49,6 +53,16 @@ func LogEnable(logtypes ...string) {
 			LogRF433_ = log.New(os.Stderr, "RF433"+" ", log.LstdFlags)
 			LogMQTT_ = log.New(os.Stderr, "MQTT"+" ", log.LstdFlags)
 			LogBTN_ = log.New(os.Stderr, "BTN"+" ", log.LstdFlags)
+			LogAudit_ = log.New(os.Stderr, "AUDIT"+" ", log.LstdFlags)
 		}
 	}
 }
+
+func LogAuditToFile(filename string) error {
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	LogAudit_ = log.New(fh, "", log.LstdFlags)
+	return nil
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -27,17 +28,19 @@ type SerialLine []byte
 
 var (
 	DebugFlags_ string
+	PasswdUser_ string
 	ps_         *pubsub.PubSub
 )
 
 func init() {
 	flag.StringVar(&DebugFlags_, "debug", "", "List of DebugFlags separated by ,")
+	flag.StringVar(&PasswdUser_, "passwd", "", "user:role - read a password from stdin, print a line for GOMQTTWEBFRONT_PASSWORDFILE and exit")
 	ps_ = pubsub.NewNonBlocking(100)
 }
 
 //Connect and keep trying to connect to MQTT Broker
 //And while we cannot, still provide as much functionality as possible
-func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime() {
+func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(output *shutdownStage) {
 	//Start Channel Gobblers and Functionality that works without mqtt
 	//These shut down once we send PS_SHUTDOWN_CONSUMER
 	//consume MQTT_ledpattern_chan_ and MQTT_ir_chan_
@@ -47,8 +50,9 @@ func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime() {
 			select {
 			case <-shutdown_c:
 				return
-			case <-MQTT_sendmsg_chan_:
+			case outmsg := <-MQTT_sendmsg_chan_:
 				//drop msg
+				outmsg.published(fmt.Errorf("not connected to MQTT broker"))
 			}
 		}
 	}()
@@ -59,31 +63,56 @@ func goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime() {
 		mqttc := ConnectMQTTBroker(EnvironOrDefault("GOMQTTWEBFRONT_MQTTBROKER", DEFAULT_GOMQTTWEBFRONT_MQTTBROKER), EnvironOrDefault("GOMQTTWEBFRONT_CLIENTID", r3events.CLIENTID_WEBFRONT))
 		//start real goroutines after mqtt connected
 		if mqttc != nil {
-			topic_in_chan := SubscribeMultipleAndForwardToChannel(mqttc, ws_allowed_ctx_all)
+			//GoLightCtrl names sent by web users or other clients below by/ change state like those sent to the name itself
+			topic_in_chan := SubscribeMultipleAndForwardToChannel(mqttc, append([]string{topic_golightctrl_by_pre_ + "#"}, Devices().Topics()...))
+			go goUpdateDeviceSubscriptions(ps_, mqttc, topic_in_chan)
+			if prefix := EnvironOrDefault("GOMQTTWEBFRONT_HADISCOVERY", ""); len(prefix) > 0 {
+				subscribeHADiscovery(mqttc, prefix)
+			}
 			go func(c mqtt.Client, msg_in_chan chan mqtt.Message) {
 				// if msg.Retained() {
 				// 	return
 				// }
 				for msg := range msg_in_chan {
+					if devs, isavailability := Devices().ByAvailabilityTopic(msg.Topic()); isavailability {
+						updateAvailability(ps_, devs, msg.Payload())
+						continue
+					}
+					ctx := ctxForTopic(msg.Topic())
+					if _, known := Devices().ByTopic(ctx); !known {
+						continue
+					}
 					lp := make(map[string]interface{}, 10)
+					var la []interface{}
+					webmsg := wsMessage{Ctx: ctx, Ts: time.Now().Unix(), Source: ws_source_live_}
+					if msg.Retained() {
+						webmsg.Source = ws_source_retained_
+					} else if isOwnEcho(msg.Topic(), msg.Payload()) {
+						webmsg.Source = ws_source_echo_
+					}
 					//Error check, then forward
 					if err := json.Unmarshal(msg.Payload(), &lp); err == nil {
-						webmsg := wsMessage{Ctx: msg.Topic(), Data: lp}
-						ps_.Pub(webmsg, PS_WEBSOCK_ALL)
+						webmsg.Data = lp
+					} else if err := json.Unmarshal(msg.Payload(), &la); err == nil {
+						webmsg.Data = la
 					} else {
-						webmsg := wsMessage{Ctx: msg.Topic(), Data: string(msg.Payload())}
-						ps_.Pub(webmsg, PS_WEBSOCK_ALL)
+						webmsg.Data = string(msg.Payload())
 					}
+					ps_.Pub(webmsg, PS_WEBSOCK_ALL)
 				}
 			}(mqttc, topic_in_chan)
 			ps_.Pub(true, PS_SHUTDOWN_CONSUMER) //shutdown all chan consumers for mqttc == nil
 			time.Sleep(5 * time.Second)         //avoid goLinearizeRFSender that we start below to shutdown right away
-			go goSendMQTTMsgToBroker(mqttc, MQTT_sendmsg_chan_)
+			output.Go(func(ctx context.Context) { goSendMQTTMsgToBroker(ctx, mqttc, MQTT_sendmsg_chan_) })
 			//and LAST but not least:
 			RequestStatusFromAllFancyLightsMQTT(mqttc)
 			return // no need to keep on trying, mqtt-auto-reconnect will do the rest now
 		} else {
-			time.Sleep(5 * time.Minute)
+			select {
+			case <-time.After(5 * time.Minute):
+			case <-output.ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -94,8 +123,70 @@ func main() {
 		LogEnable(strings.Split(DebugFlags_, ",")...)
 	}
 
-	go goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime()
-	go goRunWebserver()
+	if len(PasswdUser_) > 0 {
+		nameandrole := strings.SplitN(PasswdUser_, ":", 2)
+		if len(nameandrole) != 2 {
+			nameandrole = append(nameandrole, RoleMember)
+		}
+		if err := PrintPasswdLine(nameandrole[0], nameandrole[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if auditlog := EnvironOrDefault("GOMQTTWEBFRONT_AUDITLOG", ""); len(auditlog) > 0 {
+		if err := LogAuditToFile(auditlog); err != nil {
+			panic(err)
+		}
+	}
+	if err := SetTrustedProxies(EnvironOrDefault("GOMQTTWEBFRONT_TRUSTEDPROXIES", DEFAULT_GOMQTTWEBFRONT_TRUSTEDPROXIES)); err != nil {
+		panic(err)
+	}
+	auth, err := NewWebAuth(EnvironOrDefault("GOMQTTWEBFRONT_AUTH", AuthNone))
+	if err != nil {
+		panic(err)
+	}
+
+	devicesfile := EnvironOrDefault("GOMQTTWEBFRONT_DEVICES", DEFAULT_GOMQTTWEBFRONT_DEVICES)
+	devices, devicesmtime, err := LoadDeviceConfigs(devicesfile)
+	if err != nil {
+		panic(err)
+	}
+	registry, err := NewDeviceRegistry(devices)
+	if err != nil {
+		panic(err)
+	}
+	setDevices(registry)
+	go goManageDevices(ps_, devicesfile, devices, devicesmtime)
+
+	if err := SetLocation(EnvironOrDefault("GOMQTTWEBFRONT_LATITUDE", DEFAULT_GOMQTTWEBFRONT_LATITUDE), EnvironOrDefault("GOMQTTWEBFRONT_LONGITUDE", DEFAULT_GOMQTTWEBFRONT_LONGITUDE)); err != nil {
+		panic(err)
+	}
+	if err := SetAllowedOrigins(EnvironOrDefault("GOMQTTWEBFRONT_ALLOWEDORIGINS", "")); err != nil {
+		panic(err)
+	}
+	if err := SetStaleAfter(EnvironOrDefault("GOMQTTWEBFRONT_STALEAFTER", "")); err != nil {
+		panic(err)
+	}
+	if colormodelfile := EnvironOrDefault("GOMQTTWEBFRONT_COLORMODEL", ""); len(colormodelfile) > 0 {
+		if err := LoadColorModel(colormodelfile); err != nil {
+			panic(err)
+		}
+	}
+
+	var circadian *CircadianConfig
+	if circadianfile := EnvironOrDefault("GOMQTTWEBFRONT_CIRCADIAN", ""); len(circadianfile) > 0 {
+		if circadian, err = LoadCircadianConfig(circadianfile); err != nil {
+			panic(err)
+		}
+	}
+
+	go goFollowDawnDusk(ps_, circadian)
+	input := newShutdownStage("webserver")
+	output := newShutdownStage("mqtt")
+	go goConnectToMQTTBrokerAndFunctionWithoutInTheMeantime(output)
+	input.Go(func(ctx context.Context) { goRunWebserver(ctx, auth) })
 
 	// wait on Ctrl-C or sigInt or sigKill
 	func() {
@@ -105,4 +196,21 @@ func main() {
 		fmt.Println("SIGINT received, exiting gracefully ...")
 	}()
 
+	//no more requests, websocket and SSE clients are told we go away
+	deadline, cancel := context.WithTimeout(context.Background(), shutdown_timeout_)
+	defer cancel()
+	input.Stop(deadline)
+
+	//keep the last states for next time
+	saved_c := make(chan error, 1)
+	select {
+	case statecache_save_chan_ <- saved_c:
+		<-saved_c
+	case <-time.After(5 * time.Second):
+		LogMain_.Print("state cache not saved, webserver not answering")
+	}
+
+	//then everything else, queued MQTT messages are still sent before we disconnect
+	ps_.Pub(true, PS_SHUTDOWN)
+	output.Stop(deadline)
 }
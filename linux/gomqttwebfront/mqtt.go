@@ -2,7 +2,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,9 +19,22 @@ const MQTT_QOS_NOCONFIRMATION byte = 0
 const MQTT_QOS_REQCONFIRMATION byte = 1
 const MQTT_QOS_4STPHANDSHAKE byte = 2
 
+const mqtt_publish_timeout_ = 5 * time.Second
+const mqtt_echo_window_ = 5 * time.Second
+
+const (
+	topic_golightctrl_pre_        = r3events.TOPIC_ACTIONS + r3events.CLIENTID_LIGHTCTRL + "/"
+	topic_golightctrl_by_pre_     = topic_golightctrl_pre_ + "by/"
+	topic_golightctrl_by_web_pre_ = topic_golightctrl_by_pre_ + "web/"
+)
+
 var mqtt_topics_we_subscribed_ map[string]byte
 var mqtt_topics_we_subscribed_lock_ sync.RWMutex
 
+// what we last published per topic, to tell our own messages coming back from the broker
+var mqtt_own_publishes_ = make(map[string]mqttOwnPublish, 20)
+var mqtt_own_publishes_lock_ sync.Mutex
+
 func init() {
 	mqtt_topics_we_subscribed_ = make(map[string]byte, 1)
 }
@@ -79,29 +96,115 @@ func RequestStatusFromAllFancyLightsMQTT(mqttc mqtt.Client) {
 	mqttc.Publish(r3events.ACT_ALLFANCYLIGHT_PLEASEREPEAT, MQTT_QOS_NOCONFIRMATION, false, []byte{})
 }
 
-func goSendMQTTMsgToBroker(mqttc mqtt.Client, outmsg_chan chan MQTTOutboundMsg) {
+// once ctx is done, sends what is still queued and disconnects
+func goSendMQTTMsgToBroker(ctx context.Context, mqttc mqtt.Client, outmsg_chan chan MQTTOutboundMsg) {
 	if mqttc == nil {
 		return
 	}
-	for outmsg := range outmsg_chan {
+	defer mqttc.Disconnect(mqtt_disconnect_quiesce_ms_)
+	draining := false
+	for {
+		var outmsg MQTTOutboundMsg
+		if draining {
+			select {
+			case outmsg = <-outmsg_chan:
+			default:
+				return
+			}
+		} else {
+			select {
+			case outmsg = <-outmsg_chan:
+			case <-ctx.Done():
+				draining = true
+				continue
+			}
+		}
 		LogMQTT_.Printf("goSendMQTTMsgToBroker(%+v)", outmsg)
+		var payload []byte
 		switch outpayload := outmsg.msg.(type) {
 		case string:
-			mqttc.Publish(outmsg.topic, 0, false, []byte(outpayload))
+			payload = []byte(outpayload)
 		case []byte:
-			mqttc.Publish(outmsg.topic, 0, false, outpayload)
+			payload = outpayload
 		case map[string]interface{}:
 			if bytes, err := json.Marshal(outpayload); err == nil {
-				mqttc.Publish(outmsg.topic, 0, false, bytes)
+				payload = bytes
 			}
 		case r3events.YamahaIRCmd, r3events.SetPipeLEDsPattern, r3events.FancyLight, r3events.CeilingScript, r3events.LightCtrlActionOnName:
-			mqttc.Publish(outmsg.topic, 0, false, r3events.MarshalEvent2ByteOrPanic(outpayload))
-		default:
+			payload = r3events.MarshalEvent2ByteOrPanic(outpayload)
+		}
+		if payload == nil {
 			//send nothing
+			outmsg.published(fmt.Errorf("can't send payload of type %T", outmsg.msg))
+			continue
+		}
+		topic := outmsg.publishTopic()
+		rememberOwnPublish(topic, payload)
+		tk := mqttc.Publish(topic, 0, false, payload)
+		if outmsg.onpublished != nil {
+			go func(outmsg MQTTOutboundMsg, tk mqtt.Token) {
+				if !tk.WaitTimeout(mqtt_publish_timeout_) {
+					outmsg.published(fmt.Errorf("timeout publishing to MQTT broker"))
+				} else {
+					outmsg.published(tk.Error())
+				}
+			}(outmsg, tk)
 		}
 	}
 }
 
+// GoLightCtrl names sent by a web user go to action/GoLightCtrl/by/web/<user>/<name>, so the GoLightCtrl ACL knows who it was
+func (outmsg MQTTOutboundMsg) publishTopic() string {
+	if len(outmsg.by) == 0 {
+		return outmsg.topic
+	}
+	if dev, known := Devices().ByTopic(outmsg.topic); !known || (dev.Kind != DeviceBasic && dev.Kind != DeviceRF) {
+		return outmsg.topic
+	}
+	name := strings.TrimPrefix(outmsg.topic, topic_golightctrl_pre_)
+	if name == outmsg.topic || strings.Contains(name, "/") {
+		return outmsg.topic
+	}
+	return topic_golightctrl_by_web_pre_ + outmsg.by + "/" + name
+}
+
+// the ctx web clients know a GoLightCtrl name as, that somebody sent below action/GoLightCtrl/by/
+func ctxForTopic(topic string) string {
+	if !strings.HasPrefix(topic, topic_golightctrl_by_pre_) {
+		return topic
+	}
+	return topic_golightctrl_pre_ + topic[strings.LastIndex(topic, "/")+1:]
+}
+
+func rememberOwnPublish(topic string, payload []byte) {
+	mqtt_own_publishes_lock_.Lock()
+	defer mqtt_own_publishes_lock_.Unlock()
+	mqtt_own_publishes_[topic] = mqttOwnPublish{payload: payload, ts: time.Now()}
+	for tp, own := range mqtt_own_publishes_ {
+		if time.Since(own.ts) > mqtt_echo_window_ {
+			delete(mqtt_own_publishes_, tp)
+		}
+	}
+}
+
+// tells if we just published this ourselves. Only the first one coming back counts
+func isOwnEcho(topic string, payload []byte) bool {
+	mqtt_own_publishes_lock_.Lock()
+	defer mqtt_own_publishes_lock_.Unlock()
+	own, inmap := mqtt_own_publishes_[topic]
+	if !inmap || time.Since(own.ts) > mqtt_echo_window_ || !bytes.Equal(own.payload, payload) {
+		return false
+	}
+	delete(mqtt_own_publishes_, topic)
+	return true
+}
+
+func (outmsg MQTTOutboundMsg) published(err error) {
+	if outmsg.onpublished != nil {
+		outmsg.onpublished(err)
+	}
+}
+
 func SubscribeAndAttachCallback(mqttc mqtt.Client, filter string, callback mqtt.MessageHandler) {
 	tk := mqttc.Subscribe(filter, 0, callback)
 	tk.Wait()
@@ -136,6 +239,11 @@ func SubscribeAndForwardToChannel(mqttc mqtt.Client, filter string) (channel cha
 
 func SubscribeMultipleAndForwardToChannel(mqttc mqtt.Client, filters []string) (channel chan mqtt.Message) {
 	channel = make(chan mqtt.Message, 100)
+	SubscribeMultipleAndForwardToGivenChannel(mqttc, filters, channel)
+	return
+}
+
+func SubscribeMultipleAndForwardToGivenChannel(mqttc mqtt.Client, filters []string, channel chan mqtt.Message) {
 	filtermap := make(map[string]byte, len(filters))
 	for _, topicfilter := range filters {
 		filtermap[topicfilter] = 0 //qos == 0
@@ -156,7 +264,6 @@ func SubscribeMultipleAndForwardToChannel(mqttc mqtt.Client, filters []string) (
 		LogMQTT_.Printf("SubscribeMultipleAndForwardToChannel successfull")
 		addSubscribedTopics(tk.(*mqtt.SubscribeToken).Result())
 	}
-	return
 }
 
 func UnsubscribeMultiple(mqttc mqtt.Client, topics ...string) {
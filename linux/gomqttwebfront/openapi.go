@@ -0,0 +1,151 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+// served at /api/v1/openapi.json, keep in sync with webHandleAPI
+const api_openapi_json_ = `{
+  "openapi": "3.0.2",
+  "info": {
+    "title": "realraum gomqttwebfront",
+    "version": "1.0.0",
+    "description": "Switch lights and devices at realraum. Same rules as the websocket: only members and, for some devices, guests may send. With a password file, send HTTP basic auth or the session cookie from /login. PUT and POST need header X-Requested-With, or X-CSRF-Token with the value of cookie gomqttwebfront_csrf, unless you send basic auth."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "components": {
+    "securitySchemes": {
+      "basic": {"type": "http", "scheme": "basic"},
+      "session": {"type": "apiKey", "in": "cookie", "name": "gomqttwebfront_session"}
+    },
+    "parameters": {
+      "kind": {"name": "kind", "in": "path", "required": true, "schema": {"type": "string", "enum": ["fancy", "basic", "sonoff", "esphome", "zigbee2mqtt", "rf", "other", "haswitch", "halight"]}},
+      "name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "schemas": {
+      "Device": {
+        "type": "object",
+        "required": ["Name", "Kind"],
+        "properties": {
+          "Name": {"type": "string"},
+          "Kind": {"type": "string"},
+          "StateTopic": {"type": "string"},
+          "CommandTopic": {"type": "string"},
+          "SendOnConnect": {"type": "boolean"},
+          "Guest": {"type": "boolean", "description": "guests may send to it, not only members"},
+          "Schema": {"type": "string", "description": "how commands are validated. Without, the device is read-only"},
+          "Members": {"type": "array", "items": {"type": "string"}},
+          "ShowAs": {"type": "string"},
+          "AvailabilityTopic": {"type": "string"},
+          "Discovery": {"type": "string"},
+          "Capabilities": {"type": "array", "items": {"type": "string"}},
+          "PayloadOn": {"type": "string"},
+          "PayloadOff": {"type": "string"},
+          "BrightnessScale": {"type": "integer"},
+          "MinMireds": {"type": "integer"},
+          "MaxMireds": {"type": "integer"}
+        }
+      },
+      "Frame": {
+        "type": "object",
+        "required": ["ctx", "data"],
+        "properties": {
+          "ctx": {"type": "string"},
+          "data": {"description": "whatever the device published"},
+          "ts": {"type": "integer", "description": "when we received it, unix seconds"},
+          "source": {"type": "string", "enum": ["retained", "live", "echo"]},
+          "stale": {"type": "boolean", "description": "may have changed since"}
+        }
+      },
+      "DeviceState": {
+        "type": "object",
+        "required": ["device", "state"],
+        "properties": {
+          "device": {"$ref": "#/components/schemas/Device"},
+          "online": {"type": "boolean", "description": "missing unless the device tells us"},
+          "state": {"allOf": [{"$ref": "#/components/schemas/Frame"}], "nullable": true}
+        }
+      },
+      "Published": {
+        "type": "object",
+        "required": ["ctx", "status"],
+        "properties": {
+          "ctx": {"type": "string", "description": "MQTT topic it was sent to"},
+          "status": {"type": "string", "enum": ["published", "superseded"], "description": "superseded if a newer command for the same device was sent instead"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "string"}}
+      }
+    },
+    "responses": {
+      "Error": {"description": "what went wrong", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  },
+  "security": [{}, {"basic": []}, {"session": []}],
+  "paths": {
+    "/devices": {
+      "get": {
+        "summary": "list all devices",
+        "operationId": "listDevices",
+        "responses": {
+          "200": {"description": "devices", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Device"}}}}},
+          "405": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{kind}/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}],
+      "get": {
+        "summary": "a device, if it is online and its last known state",
+        "operationId": "getDevice",
+        "responses": {
+          "200": {"description": "device state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeviceState"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "send a new state or action name to a device",
+        "description": "The body is what a websocket client would send as data, e.g. {\"r\":1000,\"g\":0,\"b\":0,\"ww\":0,\"cw\":0} for a fancy light, {\"Action\":\"on\"} or just on for rf and basic lights, ON for a sonoff. Returns once it is published to MQTT. POST does the same. 503 with Retry-After if the device is offline or too many commands are waiting.",
+        "operationId": "setDevice",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {}},
+            "text/plain": {"schema": {"type": "string"}, "example": "on"}
+          }
+        },
+        "responses": {
+          "200": {"description": "published", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Published"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"},
+          "504": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/scenes": {
+      "get": {
+        "summary": "names of the scenes GoLightCtrl knows. Restore one with PUT /devices/other/scene {\"Action\":\"restore\",\"Name\":...}",
+        "operationId": "listScenes",
+        "responses": {
+          "200": {"description": "scene names", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "this document",
+        "operationId": "getOpenAPI",
+        "responses": {"200": {"description": "OpenAPI 3 document", "content": {"application/json": {}}}}
+      }
+    }
+  }
+}
+`
@@ -157,7 +157,7 @@ function clickedSaveFancyPreset()
 }
 
 
-var webSocketUrl = 'ws://'+window.location.host+'/sock';
+var webSocketUrl = (window.location.protocol == 'https:' ? 'wss://' : 'ws://')+window.location.host+'/sock';
 var cgiUrl = '/cgi-bin/fallback.cgi';
 
 var webSocketSupport = null;
@@ -216,6 +216,13 @@ $(window).ready(resizeRoomImg);
           renderButtonStates();
         };
       }(topic, keyid)));
+      //what the light actually is, also after someone used the keypad
+      ws.registerContext(mqtttopic_golightctrl_state(keyid), (function(keyid) {
+        return function(data) {
+          buttons[keyid] = (data.On == true);
+          renderButtonStates();
+        };
+      }(keyid)));
     });
 
     ws.registerContext(mqtttopic_activatescript,handleExternalActivateScript);
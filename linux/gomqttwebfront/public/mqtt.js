@@ -1,10 +1,15 @@
 
 var mqtttopic_activatescript = "action/ceilingscripts/activatescript";
 var mqtttopic_pipeledpattern = "action/PipeLEDs/pattern";
+var mqtttopic_golightctrl_scene = "action/GoLightCtrl/scene";
+var mqtttopic_golightctrl_scenelist = "realraum/GoLightCtrl/scenes";
 
 function mqtttopic_golightctrl(lightname) {
   return "action/GoLightCtrl/"+lightname;
 }
+function mqtttopic_golightctrl_state(lightname) {
+  return "realraum/GoLightCtrl/"+lightname;
+}
 function mqtttopic_fancylight(fancyid) {
   return "action/"+fancyid+"/light";
 }
@@ -120,6 +125,12 @@ function getr3ledfactors(name) {
     return r3_led_factors_["_default_"];
 }
 
+// the server sets this cookie, pages elsewhere can't read it and so can't switch
+function csrfToken() {
+  var m = document.cookie.match(/(?:^|;\s*)gomqttwebfront_csrf=([^;]*)/);
+  return m ? m[1] : "";
+}
+
 function sendMQTT_XHTTP(ctx, data) {
   var req = new XMLHttpRequest;
   req.open("POST", cgiUrl, true);
@@ -130,8 +141,9 @@ function sendMQTT_XHTTP(ctx, data) {
     var data = JSON.parse(req.responseText);
     setButtonStates(data);
   };
-  var param = "Ctx=" + encodeURIComponent(ctx);
-  params = params + "&Data="+encodeURIComponent(data);
+  var params = "Ctx=" + encodeURIComponent(ctx);
+  params = params + "&Data="+encodeURIComponent(typeof data == "string" ? data : JSON.stringify(data));
+  params = params + "&Csrf="+encodeURIComponent(csrfToken());
   params = params.replace(/%20/g, '+');
   req.overrideMimeType("application/json");
   req.setRequestHeader("googlechromefix","");
@@ -338,11 +338,100 @@ function popupFancyColorPicker(event) {
 }
 
 
+function handleExternalSceneList(data) {
+  var select = $("#sceneselect");
+  var selected = select.val();
+  select.empty();
+  data.forEach(function(scenename) {
+    var option = document.createElement("option");
+    option.value = scenename;
+    option.textContent = scenename;
+    select.append(option);
+  });
+  select.val(selected);
+}
+
+function sendSceneCmd(action, scenename) {
+  if (!scenename) { return; }
+  sendMQTT(mqtttopic_golightctrl_scene,{Name:scenename,Action:action});
+}
+
 function setLedPipePattern(data) {
   sendMQTT(mqtttopic_pipeledpattern, data);
 }
 
-var webSocketUrl = 'ws://'+window.location.host+'/sock';
+// data: topic -> online. Names are the 2nd part of the topic, e.g. action/ceiling4/light or realraum/olgadecke/state
+function handleAvailability(data) {
+  Object.keys(data).forEach(function(topic) {
+    var name = topic.split("/")[1];
+    $('[name="'+name+'"]').closest(".switchbox").toggleClass("deviceoffline", !data[topic]);
+  });
+}
+
+var discovered_state_ = {};
+
+function isDiscoveredDeviceOn(device, data) {
+  if (device.Kind == "halight") {
+    return data && data.state == "ON";
+  }
+  return data == (device.PayloadOn || "ON");
+}
+
+function handleDeviceList(devices) {
+  var elem = $("#discovereddevices");
+  elem.empty();
+  var discovered = devices.filter(function(device) { return device.Discovery; });
+  $("#discovereddevicesbox").css("display", discovered.length > 0 ? "" : "none");
+  discovered.forEach(function(device) {
+    var id = "discovered"+device.Kind+device.Name;
+    var extrahtml = "";
+    if (device.Kind == "halight" && (device.Capabilities || []).indexOf("brightness") >= 0) {
+      extrahtml = '<input type="range" min="1" max="'+(device.BrightnessScale || 255)+'" step="1" class="discoveredbrightnessslider" id="'+id+'brightness">';
+    }
+    elem.append('\
+      <span class="alignbuttonsleft">\
+        <div class="onoffswitch">\
+            <input type="checkbox" class="onoffswitch-checkbox" id="'+id+'">\
+              <label class="onoffswitch-label" for="'+id+'">\
+                  <span class="onoffswitch-inner"></span>\
+                  <span class="onoffswitch-switch"></span>\
+              </label>\
+          </div>\
+      </span>\
+      <div class="switchnameright">'+device.Name+'</div>'+extrahtml+'<br>');
+    var checkbox = document.getElementById(id);
+    var slider = document.getElementById(id+"brightness");
+    var statetopic = device.StateTopic || device.Topic;
+    var commandtopic = device.CommandTopic || device.Topic;
+    var showState = function(data) {
+      discovered_state_[statetopic] = data;
+      checkbox.checked = isDiscoveredDeviceOn(device, data);
+      if (slider && data && data.brightness) {
+        slider.value = data.brightness;
+      }
+    };
+    if (statetopic) {
+      ws.registerContext(statetopic, showState);
+      if (statetopic in discovered_state_) {
+        showState(discovered_state_[statetopic]);
+      }
+    }
+    $(checkbox).on("click", function(event) {
+      if (device.Kind == "halight") {
+        sendMQTT(commandtopic, {state: checkbox.checked ? "ON" : "OFF"});
+      } else {
+        sendMQTT(commandtopic, checkbox.checked ? "on" : "off");
+      }
+    });
+    if (slider) {
+      $(slider).on("change", function(event) {
+        sendMQTT(commandtopic, {state: "ON", brightness: parseInt(slider.value, 10)});
+      });
+    }
+  });
+}
+
+var webSocketUrl = (window.location.protocol == 'https:' ? 'wss://' : 'ws://')+window.location.host+'/sock';
 var cgiUrl = '/cgi-bin/mswitch.cgi';
 //var cgiUrl = 'fake.json';
 
@@ -422,12 +511,9 @@ populatedivfancyswitchboxes(document.getElementById("divfancylightswitchboxes"),
     // register MQTT Update Handler: Basiclights
     $(".basiclight_checkbox").each(function(oelem){
       var topic = mqtttopic_golightctrl(oelem.getAttribute("name"));
-      ws.registerContext(topic, function(elem) {
-        return function(data) {
-          if (data.Action == "1" || data.Action == "on" || data.Action == "send" || data.Action == 1)
-            elem.checked = true;
-          else
-            elem.checked = false;
+      var setChecked = function(elem) {
+        return function(ison) {
+          elem.checked = ison;
 
           //now check if all are checked and thus also check the "all"-checkbox
           var allelem=undefined;
@@ -440,7 +526,14 @@ populatedivfancyswitchboxes(document.getElementById("divfancylightswitchboxes"),
           });
           allelem.checked=checked;
         }
-      }(oelem));
+      }(oelem);
+      ws.registerContext(topic, function(data) {
+        setChecked(data.Action == "1" || data.Action == "on" || data.Action == "send" || data.Action == 1);
+      });
+      //what the light actually is, also after someone used the keypad
+      ws.registerContext(mqtttopic_golightctrl_state(oelem.getAttribute("name")), function(data) {
+        setChecked(data.On == true);
+      });
     });
     // register MQTT Update Handler: RF433 Poweroutlets
     Object.keys(topics_to_subscribe).forEach(function(topic) {
@@ -504,6 +597,12 @@ populatedivfancyswitchboxes(document.getElementById("divfancylightswitchboxes"),
     registerFunctionForFancyLightUpdate(handleExternalFancySetting);
     // register MQTT Update Handler: ScriptCtrl
     ws.registerContext(mqtttopic_activatescript, handleExternalActivateScript);
+    // register MQTT Update Handler: Scenes
+    ws.registerContext(mqtttopic_golightctrl_scenelist, handleExternalSceneList);
+    // register Handler: Devices that went offline
+    ws.registerContext("availability", handleAvailability);
+    // register Handler: Device List incl. Home Assistant discovered devices
+    ws.registerContext("devices", handleDeviceList);
   }
 
   //set background color for fancylightpresetbuttons according to ledr=, ledb=, etc.
@@ -522,6 +621,12 @@ populatedivfancyswitchboxes(document.getElementById("divfancylightswitchboxes"),
   $("input.esphomer3_checkbox").on("click",eventOnEspHomeButton);
   $("input.zigbee2mqtt_checkbox").on("click",eventOnZigbee2MqttButton);
   $(".fancylightcolourtempselectorbutton").on("click",popupFancyColorPicker);
+  $("#scenerestorebutton").on("click",function(event){ sendSceneCmd("restore", $("#sceneselect").val()); });
+  $("#scenedeletebutton").on("click",function(event){
+    var scenename = $("#sceneselect").val();
+    if (scenename && confirm("Delete scene "+scenename+"?")) { sendSceneCmd("delete", scenename); }
+  });
+  $("#scenesavebutton").on("click",function(event){ sendSceneCmd("save", prompt("Save current lights as scene:", $("#sceneselect").val() || "")); });
   $(document).on("click",function(event){
     if (!document.getElementById("fancycolorpicker").contains(event.target) &&
       $(".fancylightcolourtempselectorbutton").has(event.target).length==0)
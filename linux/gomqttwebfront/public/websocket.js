@@ -21,6 +21,7 @@ ws.ondisconnect=false;
 ws.retrytimer=false;
 ws.contexts = {};
 ws.retryinterval_ms = 1500;
+ws.protocol_batch = "r3batch.v2";
 
 ws.waitandreconnect = function(uri) {
 	if (ws.retrytimer == false)
@@ -43,12 +44,21 @@ ws.stopreconnecting = function() {
 
 ws.open = function(uri) {
 	ws.stopreconnecting();
-	ws.ws=new WebSocket(uri);
+	ws.pending = {};
+	var wsuri = uri;
+	if (ws.subscriptions.length > 0) {
+		wsuri += (uri.indexOf("?") < 0 ? "?" : "&") + "subscribe=" + encodeURIComponent(ws.subscriptions.join(","));
+	}
+	// servers that know batching send several updates in one {"ctx":"batch","data":[{ctx,data},...]}
+	ws.ws=new WebSocket(wsuri, [ws.protocol_batch]);
 	ws.ws.onmessage = function(response){
 		var m = JSON.parse(response.data);
-		if (m["ctx"] && m["data"] && typeof(ws.contexts[m.ctx]) == "function") {
-			ws.contexts[m.ctx](m.data);
-		}
+		var messages = (m["ctx"] == "batch" && ws.ws.protocol == ws.protocol_batch) ? m.data : [m];
+		messages.forEach(function(m) {
+			if (m["ctx"] && m["data"] && typeof(ws.contexts[m.ctx]) == "function") {
+				ws.contexts[m.ctx](m.data, m); // m also has ts, source and stale
+			}
+		});
 	}
  	ws.ws.onopen = function(){
 		ws.ws.onclose = function(){
@@ -79,13 +89,58 @@ ws.registerContext = function(ctx, handler) {
 }
 
 
-ws.send = function(ctx, data) {
+ws.send = function(ctx, data, onreply) {
 	if (ws.ws) {
-		var m = {ctx: ctx, data:data};
+		ws.lastid += 1;
+		var m = {ctx: ctx, data:data, id:String(ws.lastid)};
+		ws.pending[m.id] = onreply || false;
 		ws.ws.send(JSON.stringify(m));
 	}
 }
 
+// only get ctx matching these patterns (+ and # as in MQTT) instead of everything, from now on and after reconnects
+ws.subscriptions = [];
+ws.subscribe = function(patterns) {
+	ws.subscriptions = ws.subscriptions.concat(patterns);
+	if (ws.isopen()) {
+		ws.send("subscribe", patterns);
+	}
+}
+
+ws.unsubscribe = function(patterns) {
+	var subscribed = ws.subscriptions.length > 0;
+	ws.subscriptions = ws.subscriptions.filter(function(p) { return patterns.indexOf(p) < 0; });
+	if (subscribed && ws.isopen()) {
+		ws.send("unsubscribe", patterns);
+	}
+}
+
 ws.isopen = function() {
 	return ws.ws && ws.ws.readyState == 1;
-}
\ No newline at end of file
+}
+
+// server tells us what happened to a request we sent: accepted, rejected, busy, published, superseded or failed
+ws.lastid = 0;
+ws.pending = {};
+ws.registerContext("reply", function(reply) {
+	var onreply = ws.pending[reply.id];
+	if (reply.status != "accepted") {
+		delete ws.pending[reply.id];
+	}
+	if (typeof(onreply) == "function") {
+		onreply(reply);
+	}
+	if ((reply.status == "rejected" || reply.status == "busy" || reply.status == "failed") && typeof(ws["onfailure"]) == "function") {
+		ws.onfailure(reply);
+	}
+});
+
+// default: show failures for a few seconds at the bottom of the page
+ws.onfailure = function(reply) {
+	console.error("request", reply.status, reply.ctx, reply.error);
+	var note = document.createElement("div");
+	note.textContent = reply.ctx + ": " + reply.status + (reply.error ? " (" + reply.error + ")" : "");
+	note.style.cssText = "position:fixed; bottom:0; left:0; right:0; background-color:#c00; color:white; padding:0.5em; z-index:100;";
+	document.body.appendChild(note);
+	setTimeout(function() { document.body.removeChild(note); }, 5000);
+}
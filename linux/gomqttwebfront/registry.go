@@ -0,0 +1,432 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btittelbach/pubsub"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	DEFAULT_GOMQTTWEBFRONT_DEVICES  = "devices.json"
+	DeviceFancy                     = "fancy"
+	DeviceBasic                     = "basic"
+	DeviceSonoff                    = "sonoff"
+	DeviceESPHome                   = "esphome"
+	DeviceZigbee2MQTT               = "zigbee2mqtt"
+	DeviceRF                        = "rf" //GoLightCtrl names, i.e. rf outlets, ir commands and meta actions
+	DeviceOther                     = "other"
+	DeviceHASwitch                  = "haswitch" //from Home Assistant discovery, on/off only
+	DeviceHALight                   = "halight"  //from Home Assistant discovery, json schema
+	device_registry_check_interval_ = 10 * time.Second
+)
+
+// validation schema a command topic gets unless the device says otherwise
+var device_kind_default_schema_ = map[string]string{
+	DeviceFancy:       "fancylight",
+	DeviceBasic:       "lightctrl",
+	DeviceSonoff:      "sonoff",
+	DeviceESPHome:     "esphome",
+	DeviceZigbee2MQTT: "zigbee2mqtt",
+	DeviceRF:          "lightctrl",
+	DeviceOther:       "",
+	DeviceHASwitch:    "haswitch",
+	DeviceHALight:     "halight",
+}
+
+var (
+	devices_      *DeviceRegistry
+	devices_lock_ sync.RWMutex
+)
+
+// the registry currently in use. Registries are never changed once loaded, only replaced
+func Devices() *DeviceRegistry {
+	devices_lock_.RLock()
+	defer devices_lock_.RUnlock()
+	return devices_
+}
+
+func setDevices(reg *DeviceRegistry) {
+	devices_lock_.Lock()
+	defer devices_lock_.Unlock()
+	devices_ = reg
+}
+
+// returns the devices listed in filename and when it was last changed
+func LoadDeviceConfigs(filename string) ([]DeviceConfig, int64, error) {
+	mtime, err := getFileMTime(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+	var config DeviceRegistryConfig
+	dec := json.NewDecoder(fh)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", filename, err)
+	}
+	if _, err := NewDeviceRegistry(config.Devices); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", filename, err)
+	}
+	return config.Devices, mtime, nil
+}
+
+func checkTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") || strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") {
+		return fmt.Errorf("invalid topic %s", topic)
+	}
+	return nil
+}
+
+func NewDeviceRegistry(devices []DeviceConfig) (*DeviceRegistry, error) {
+	reg := &DeviceRegistry{
+		devices:        make([]DeviceConfig, len(devices)),
+		byname:         make(map[string]*DeviceConfig, len(devices)),
+		bytopic:        make(map[string]*DeviceConfig, 2*len(devices)),
+		validators:     make(map[string]wsCtxValidator, len(devices)),
+		atomize:        make(map[string][]string, 10),
+		byavailability: make(map[string][]*DeviceConfig, len(devices)),
+		allowed:        make(map[string][]string, len(roles_)),
+		memberonly:     make(map[string]bool, len(devices)),
+	}
+	copy(reg.devices, devices)
+	for idx := range reg.devices {
+		dev := &reg.devices[idx]
+		defschema, knownkind := device_kind_default_schema_[dev.Kind]
+		if !knownkind {
+			return nil, fmt.Errorf("%s: unknown Kind %s", dev.Name, dev.Kind)
+		}
+		if len(dev.Name) == 0 {
+			return nil, fmt.Errorf("device %d has no Name", idx)
+		}
+		if _, inmap := reg.byname[dev.Kind+"/"+dev.Name]; inmap {
+			return nil, fmt.Errorf("%s %s listed twice", dev.Kind, dev.Name)
+		}
+		reg.byname[dev.Kind+"/"+dev.Name] = dev
+		if len(dev.Topic) > 0 {
+			if len(dev.StateTopic) > 0 || len(dev.CommandTopic) > 0 {
+				return nil, fmt.Errorf("%s: Topic is short for StateTopic and CommandTopic, use either", dev.Name)
+			}
+			dev.StateTopic, dev.CommandTopic = dev.Topic, dev.Topic
+		}
+		if len(dev.StateTopic) == 0 && len(dev.CommandTopic) == 0 {
+			return nil, fmt.Errorf("%s: neither StateTopic nor CommandTopic", dev.Name)
+		}
+		if len(dev.Schema) == 0 && len(dev.CommandTopic) > 0 {
+			dev.Schema = defschema
+		}
+		if len(dev.Schema) > 0 && len(dev.CommandTopic) == 0 {
+			return nil, fmt.Errorf("%s: Schema without CommandTopic", dev.Name)
+		}
+		for _, topic := range []string{dev.StateTopic, dev.CommandTopic} {
+			if len(topic) == 0 {
+				continue
+			}
+			if err := checkTopic(topic); err != nil {
+				return nil, fmt.Errorf("%s: %s", dev.Name, err)
+			}
+			if other, inmap := reg.bytopic[topic]; inmap && other != dev {
+				return nil, fmt.Errorf("%s: topic %s already used by %s", dev.Name, topic, other.Name)
+			}
+			if _, inmap := reg.bytopic[topic]; !inmap {
+				reg.bytopic[topic] = dev
+				reg.topics = append(reg.topics, topic)
+			}
+		}
+		if dev.SendOnConnect && len(dev.StateTopic) > 0 {
+			reg.sendonconnect = append(reg.sendonconnect, dev.StateTopic)
+		}
+		if len(dev.Schema) > 0 {
+			validator, inmap := ws_schemas_[dev.Schema]
+			if !inmap {
+				return nil, fmt.Errorf("%s: unknown Schema %s", dev.Name, dev.Schema)
+			}
+			reg.validators[dev.CommandTopic] = validator
+			reg.allowed[RoleMember] = append(reg.allowed[RoleMember], dev.CommandTopic)
+			if dev.Guest {
+				reg.allowed[RoleGuest] = append(reg.allowed[RoleGuest], dev.CommandTopic)
+			} else {
+				for _, ctx := range []string{dev.StateTopic, dev.CommandTopic, dev.ShowAs} {
+					if len(ctx) > 0 {
+						reg.memberonly[ctx] = true
+					}
+				}
+			}
+		}
+		if len(dev.ShowAs) > 0 {
+			if len(dev.StateTopic) == 0 {
+				return nil, fmt.Errorf("%s: ShowAs without StateTopic", dev.Name)
+			}
+			reg.atomize[dev.StateTopic] = []string{dev.ShowAs}
+		}
+	}
+	//members may be listed after the group
+	for idx := range reg.devices {
+		dev := &reg.devices[idx]
+		if len(dev.Members) == 0 {
+			continue
+		}
+		if len(dev.CommandTopic) == 0 {
+			return nil, fmt.Errorf("%s: Members without CommandTopic", dev.Name)
+		}
+		for _, member := range dev.Members {
+			if mdev, inmap := reg.bytopic[member]; !inmap || mdev.CommandTopic != member || len(mdev.Members) > 0 {
+				return nil, fmt.Errorf("%s: Member %s is not the CommandTopic of a single device", dev.Name, member)
+			}
+		}
+		reg.atomize[dev.CommandTopic] = dev.Members
+	}
+	//we subscribe availability topics too, but they are no ctx of their own
+	for idx := range reg.devices {
+		dev := &reg.devices[idx]
+		if len(dev.AvailabilityTopic) == 0 {
+			dev.AvailabilityTopic = defaultAvailabilityTopic(dev)
+		}
+		if len(dev.AvailabilityTopic) == 0 {
+			continue
+		}
+		if err := checkTopic(dev.AvailabilityTopic); err != nil {
+			return nil, fmt.Errorf("%s: %s", dev.Name, err)
+		}
+		if other, inmap := reg.bytopic[dev.AvailabilityTopic]; inmap {
+			return nil, fmt.Errorf("%s: AvailabilityTopic %s already used by %s", dev.Name, dev.AvailabilityTopic, other.Name)
+		}
+		if _, inmap := reg.byavailability[dev.AvailabilityTopic]; !inmap {
+			reg.topics = append(reg.topics, dev.AvailabilityTopic)
+		}
+		reg.byavailability[dev.AvailabilityTopic] = append(reg.byavailability[dev.AvailabilityTopic], dev)
+	}
+	return reg, nil
+}
+
+// where the firmware of a kind tells if it is online, if we know
+func defaultAvailabilityTopic(dev *DeviceConfig) string {
+	switch dev.Kind {
+	case DeviceFancy:
+		if len(dev.Members) == 0 {
+			return r3events.TOPIC_ACTIONS + dev.Name + "/" + r3events.TYPE_ONLINEJSON //h801 firmware
+		}
+	case DeviceSonoff:
+		return "tele/" + dev.Name + "/LWT" //tasmota
+	case DeviceESPHome:
+		if strings.HasSuffix(dev.StateTopic, "/state") {
+			return strings.TrimSuffix(dev.StateTopic, "/state") + "/status"
+		}
+	}
+	return ""
+}
+
+// tells if ctx is one of our topics, i.e. subscribed and known to web clients
+func (reg *DeviceRegistry) Known(ctx string) bool {
+	_, inmap := reg.bytopic[ctx]
+	return inmap
+}
+
+// MQTT topics to subscribe, state and command topics alike, since many devices report state on their command topic
+func (reg *DeviceRegistry) Topics() []string {
+	return reg.topics
+}
+
+// state topics whose last message is sent to clients once they connect
+func (reg *DeviceRegistry) SendOnConnect() []string {
+	return reg.sendonconnect
+}
+
+// command topics role may send to
+func (reg *DeviceRegistry) AllowedCtx(role string) []string {
+	return reg.allowed[role]
+}
+
+// Members may read everything. Others what guests may send to, read-only devices and ctx that are no device's
+func (reg *DeviceRegistry) MayRead(role, ctx string) bool {
+	return role == RoleMember || reg == nil || !reg.memberonly[ctx]
+}
+
+func (reg *DeviceRegistry) Validator(ctx string) (wsCtxValidator, bool) {
+	validator, inmap := reg.validators[ctx]
+	return validator, inmap
+}
+
+// ctx web clients see a message on ctx as, e.g. every member for a group
+func (reg *DeviceRegistry) Atomize(ctx string) ([]string, bool) {
+	ctxs, inmap := reg.atomize[ctx]
+	return ctxs, inmap
+}
+
+func (reg *DeviceRegistry) Lookup(kind, name string) (*DeviceConfig, bool) {
+	dev, inmap := reg.byname[kind+"/"+name]
+	return dev, inmap
+}
+
+// the device topic belongs to, as state or command topic
+func (reg *DeviceRegistry) ByTopic(topic string) (*DeviceConfig, bool) {
+	dev, inmap := reg.bytopic[topic]
+	return dev, inmap
+}
+
+// the devices that tell if they are online on topic
+func (reg *DeviceRegistry) ByAvailabilityTopic(topic string) ([]*DeviceConfig, bool) {
+	devs, inmap := reg.byavailability[topic]
+	return devs, inmap
+}
+
+// topics used by devices, to keep discovered devices from taking them over
+func deviceConfigTopics(devices []DeviceConfig) map[string]bool {
+	topics := make(map[string]bool, 2*len(devices))
+	for _, dev := range devices {
+		for _, topic := range []string{dev.Topic, dev.StateTopic, dev.CommandTopic, dev.AvailabilityTopic} {
+			if len(topic) > 0 {
+				topics[topic] = true
+			}
+		}
+	}
+	return topics
+}
+
+// devices from the file come first, discovered devices only if they don't clash with them or each other
+func mergeDiscoveredDevices(filedevices []DeviceConfig, discovered map[string]DeviceConfig) []DeviceConfig {
+	merged := append(make([]DeviceConfig, 0, len(filedevices)+len(discovered)), filedevices...)
+	usedtopics := deviceConfigTopics(filedevices)
+	usednames := make(map[string]bool, len(discovered))
+	discoverytopics := make([]string, 0, len(discovered))
+	for discoverytopic := range discovered {
+		discoverytopics = append(discoverytopics, discoverytopic)
+	}
+	sort.Strings(discoverytopics)
+	for _, discoverytopic := range discoverytopics {
+		dev := discovered[discoverytopic]
+		clashes := usednames[dev.Kind+"/"+dev.Name]
+		for topic := range deviceConfigTopics([]DeviceConfig{dev}) {
+			clashes = clashes || usedtopics[topic]
+		}
+		if clashes {
+			LogMain_.Printf("DeviceRegistry: ignoring %s, name or topics already in use", discoverytopic)
+			continue
+		}
+		for topic := range deviceConfigTopics([]DeviceConfig{dev}) {
+			usedtopics[topic] = true
+		}
+		usednames[dev.Kind+"/"+dev.Name] = true
+		merged = append(merged, dev)
+	}
+	return merged
+}
+
+// tells web clients about all devices we know
+func publishDeviceList(ps *pubsub.PubSub, reg *DeviceRegistry) {
+	ps.Pub(wsMessage{Ctx: ws_ctx_devices_, Data: reg.devices}, PS_WEBSOCK_ALL)
+}
+
+// Re-reads filename once it changed and adds or removes discovered devices.
+// A broken file is logged and the old devices kept
+func goManageDevices(ps *pubsub.PubSub, filename string, filedevices []DeviceConfig, filemtime int64) {
+	shutdown_c := ps.SubOnce(PS_SHUTDOWN)
+	ticker := time.NewTicker(device_registry_check_interval_)
+	defer ticker.Stop()
+	discovered := make(map[string]DeviceConfig, 10)
+	var rebuild_c <-chan time.Time
+	for {
+		select {
+		case <-shutdown_c:
+			return
+		case <-ticker.C:
+			newmtime, err := getFileMTime(filename)
+			if err != nil || newmtime == filemtime {
+				continue
+			}
+			devices, mtime, err := LoadDeviceConfigs(filename)
+			if err != nil {
+				LogMain_.Printf("DeviceRegistry: keeping old devices, %s", err)
+				filemtime = newmtime //don't complain again until it changes
+				continue
+			}
+			LogMain_.Printf("DeviceRegistry: loaded %d devices from %s", len(devices), filename)
+			filedevices, filemtime = devices, mtime
+		case d := <-ha_discovery_chan_:
+			if d.device == nil {
+				if _, inmap := discovered[d.topic]; !inmap {
+					continue
+				}
+				LogMain_.Printf("DeviceRegistry: %s removed", d.topic)
+				delete(discovered, d.topic)
+			} else {
+				LogMain_.Printf("DeviceRegistry: discovered %s %s", d.device.Kind, d.device.Name)
+				discovered[d.topic] = *d.device
+			}
+			//retained discovery messages come in bursts, rebuild once they're through
+			if rebuild_c == nil {
+				rebuild_c = time.After(ha_discovery_settle_time_)
+			}
+			continue
+		case <-rebuild_c:
+		}
+		rebuild_c = nil
+		reg, err := NewDeviceRegistry(mergeDiscoveredDevices(filedevices, discovered))
+		if err != nil {
+			LogMain_.Printf("DeviceRegistry: keeping old devices, %s", err)
+			continue
+		}
+		setDevices(reg)
+		ps.Pub(reg, PS_DEVICES_CHANGED)
+		publishDeviceList(ps, reg)
+		publishAvailability(ps)
+	}
+}
+
+// keeps our subscriptions in line with the registry, forwarding new topics to msg_chan
+func goUpdateDeviceSubscriptions(ps *pubsub.PubSub, mqttc mqtt.Client, msg_chan chan mqtt.Message) {
+	shutdown_c := ps.SubOnce(PS_SHUTDOWN)
+	changed_c := ps.Sub(PS_DEVICES_CHANGED)
+	defer ps.Unsub(changed_c, PS_DEVICES_CHANGED)
+	subscribed := make(map[string]bool, len(Devices().Topics()))
+	for _, topic := range Devices().Topics() {
+		subscribed[topic] = true
+	}
+	for {
+		select {
+		case <-shutdown_c:
+			return
+		case _, isopen := <-changed_c:
+			if !isopen {
+				changed_c = ps.Sub(PS_DEVICES_CHANGED)
+			}
+			topics := Devices().Topics()
+			var added, removed []string
+			for _, topic := range topics {
+				if !subscribed[topic] {
+					added = append(added, topic)
+				}
+			}
+			current := make(map[string]bool, len(topics))
+			for _, topic := range topics {
+				current[topic] = true
+			}
+			for topic := range subscribed {
+				if !current[topic] {
+					removed = append(removed, topic)
+				}
+			}
+			if len(removed) > 0 {
+				LogMQTT_.Printf("goUpdateDeviceSubscriptions: unsubscribing %s", removed)
+				UnsubscribeMultiple(mqttc, removed...)
+			}
+			if len(added) > 0 {
+				LogMQTT_.Printf("goUpdateDeviceSubscriptions: subscribing %s", added)
+				SubscribeMultipleAndForwardToGivenChannel(mqttc, added, msg_chan)
+			}
+			subscribed = current
+		}
+	}
+}
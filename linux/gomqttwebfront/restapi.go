@@ -0,0 +1,193 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	api_prefix_                  = "/api/v1/"
+	api_max_body_size_           = 4096
+	topic_golightctrl_scenelist_ = "realraum/GoLightCtrl/scenes"
+)
+
+func apiWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiWriteError(w http.ResponseWriter, status int, err error) {
+	apiWriteJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	apiWriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
+
+// the last frames we have for ctxs, missing ones left out
+func apiRetainedFrames(retained_json_chan chan JsonFuture, ctxs ...string) OurFutures {
+	ourfuture := make(chan OurFutures, 2)
+	retained_json_chan <- JsonFuture{future: ourfuture, omitempty: true, what: ctxs}
+	return <-ourfuture
+}
+
+// the ctx clients see the state of dev as. Many devices report on their command topic
+func apiStateCtx(dev *DeviceConfig) string {
+	if len(dev.ShowAs) > 0 {
+		return dev.ShowAs
+	}
+	if len(dev.StateTopic) > 0 {
+		return dev.StateTopic
+	}
+	return dev.CommandTopic
+}
+
+// handles everything below /api/v1/: devices, devices/<kind>/<name>, scenes and openapi.json which tells the details
+func webHandleAPI(w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture, auth *WebAuth) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, api_prefix_), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "devices":
+		if r.Method != "GET" {
+			apiMethodNotAllowed(w, "GET")
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, Devices().devices)
+	case len(path) == 3 && path[0] == "devices":
+		dev, inmap := Devices().Lookup(path[1], path[2])
+		if !inmap {
+			apiWriteError(w, http.StatusNotFound, fmt.Errorf("no %s device %s", path[1], path[2]))
+			return
+		}
+		switch r.Method {
+		case "GET":
+			apiHandleGetDevice(w, r, dev, retained_json_chan, auth)
+		case "PUT", "POST":
+			apiHandleSetDevice(w, r, dev, auth)
+		default:
+			apiMethodNotAllowed(w, "GET", "PUT", "POST")
+		}
+	case len(path) == 1 && path[0] == "scenes":
+		if r.Method != "GET" {
+			apiMethodNotAllowed(w, "GET")
+			return
+		}
+		frames := apiRetainedFrames(retained_json_chan, topic_golightctrl_scenelist_)
+		if len(frames) == 0 {
+			apiWriteError(w, http.StatusServiceUnavailable, fmt.Errorf("GoLightCtrl has not told us its scenes yet"))
+			return
+		}
+		var scenes struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(frames[0], &scenes); err != nil {
+			apiWriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, scenes.Data)
+	case len(path) == 1 && path[0] == "openapi.json":
+		if r.Method != "GET" {
+			apiMethodNotAllowed(w, "GET")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(api_openapi_json_))
+	default:
+		apiWriteError(w, http.StatusNotFound, fmt.Errorf("no such resource %s", r.URL.Path))
+	}
+}
+
+func apiHandleGetDevice(w http.ResponseWriter, r *http.Request, dev *DeviceConfig, retained_json_chan chan JsonFuture, auth *WebAuth) {
+	if user := auth.UserFor(r); !Devices().MayRead(user.Role, apiStateCtx(dev)) {
+		apiWriteError(w, http.StatusForbidden, fmt.Errorf("%s may not read %s", user.Name, dev.Name))
+		return
+	}
+	reply := apiDeviceState{Device: *dev, State: json.RawMessage("null")}
+	if online, known := DeviceOnline(dev); known {
+		reply.Online = &online
+	}
+	if frames := apiRetainedFrames(retained_json_chan, apiStateCtx(dev)); len(frames) > 0 {
+		reply.State = frames[0]
+	}
+	apiWriteJSON(w, http.StatusOK, reply)
+}
+
+// validates like a websocket message and waits until it is published, so scripts know it went out
+func apiHandleSetDevice(w http.ResponseWriter, r *http.Request, dev *DeviceConfig, auth *WebAuth) {
+	if len(dev.CommandTopic) == 0 || len(dev.Schema) == 0 {
+		w.Header().Set("Allow", "GET")
+		apiWriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is read-only", dev.Name))
+		return
+	}
+	//a page elsewhere may not make a visitor's browser switch things
+	if err := apiCheckCSRF(r, auth); err != nil {
+		LogWS_.Printf("CSRF: %s, from %s", err, r.RemoteAddr)
+		apiWriteError(w, http.StatusForbidden, err)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, api_max_body_size_))
+	if err != nil {
+		apiWriteError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		data = strings.TrimSpace(string(body)) //not json, e.g. an action name like on
+	}
+	ctx := dev.CommandTopic
+	user := auth.UserFor(r)
+	auditLogSend(user, r, ctx, data, user.MaySend(ctx))
+	if !user.MaySend(ctx) {
+		if user == auth.anonymous && auth.mode == AuthPasswordFile {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"r3 lights\"")
+			apiWriteError(w, http.StatusUnauthorized, fmt.Errorf("%s may not send to %s", user.Name, ctx))
+			return
+		}
+		apiWriteError(w, http.StatusForbidden, fmt.Errorf("%s may not send to %s", user.Name, ctx))
+		return
+	}
+	cmd, err := ValidateWSPayload(ctx, data)
+	if err != nil {
+		LogWS_.Printf("webHandleAPI %s: invalid payload: %s", ctx, err)
+		apiWriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := CheckDeviceOnline(ctx); err != nil {
+		apiWriteError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	published_c := make(chan error, 1)
+	if err := web_commands_.enqueue(MQTTOutboundMsg{topic: ctx, msg: cmd.payload, by: auth.PublishAs(user), onpublished: func(err error) {
+		if err == nil {
+			cmd.published()
+		}
+		published_c <- err
+	}}); err != nil {
+		w.Header().Set("Retry-After", "1")
+		apiWriteError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	select {
+	case err := <-published_c:
+		if err == errCommandSuperseded {
+			apiWriteJSON(w, http.StatusOK, wsReply{Ctx: ctx, Status: ws_status_superseded_})
+			return
+		}
+		if err != nil {
+			LogWS_.Printf("webHandleAPI %s: publish failed: %s", ctx, err)
+			apiWriteError(w, http.StatusBadGateway, err)
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, wsReply{Ctx: ctx, Status: ws_status_published_})
+	case <-time.After(mqtt_publish_timeout_ + time.Second):
+		apiWriteError(w, http.StatusGatewayTimeout, fmt.Errorf("timeout publishing to MQTT broker"))
+	}
+}
@@ -0,0 +1,221 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csrf_cookie_name_                = "gomqttwebfront_csrf"
+	csrf_form_field_                 = "Csrf"
+	csrf_header_                     = "X-CSRF-Token"
+	api_script_header_               = "X-Requested-With" // other pages can't make browsers send it without asking us first
+	DEFAULT_GOMQTTWEBFRONT_RATELIMIT = "120/1m"
+	ip_rate_limiter_max_buckets_     = 4096
+)
+
+var allowed_origins_ []string
+
+// GOMQTTWEBFRONT_ALLOWEDORIGINS, comma separated like https://licht.realraum.at or * for any. Empty means the host the request went to
+func SetAllowedOrigins(spec string) error {
+	allowed_origins_ = nil
+	for _, origin := range strings.Split(spec, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if len(origin) == 0 {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 || len(u.Path) > 0 {
+				return fmt.Errorf("%s is not an origin like https://licht.realraum.at", origin)
+			}
+		}
+		allowed_origins_ = append(allowed_origins_, strings.ToLower(origin))
+	}
+	return nil
+}
+
+// Tells if the page that made the browser send r may do so. Requests without Origin don't come from a browser's
+// cross-site request, e.g. scripts or old browsers submitting a form from our own page
+func webOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if len(allowed_origins_) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range allowed_origins_ {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// gives the client a token in a cookie, that only pages from our origin can read and send back with their requests
+func webSetCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(csrf_cookie_name_); err == nil && len(cookie.Value) > 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrf_cookie_name_,
+		Value:    newSessionToken(),
+		Path:     "/",
+		MaxAge:   int(session_lifetime_ / time.Second),
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// checks that r is a POST from one of our pages, carrying the token from the CSRF cookie. Replies with an error if not
+func webCheckCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "switching needs POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !webOriginAllowed(r) {
+		LogWS_.Printf("CSRF: origin %s not allowed, from %s", r.Header.Get("Origin"), r.RemoteAddr)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+	token := r.PostFormValue(csrf_form_field_)
+	if len(token) == 0 {
+		token = r.Header.Get(csrf_header_)
+	}
+	cookie, err := r.Cookie(csrf_cookie_name_)
+	if err != nil || len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		LogWS_.Printf("CSRF: token missing or wrong, from %s", r.RemoteAddr)
+		http.Error(w, "CSRF token missing or wrong, reload the page", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Checks that a REST API write doesn't come from a page elsewhere that made a visitor's browser send it along with our cookies.
+// Callers that log in with every request, i.e. basic auth or our reverse proxy, may omit Origin. Others need the CSRF token
+// from our own pages or, if they are scripts, api_script_header_
+func apiCheckCSRF(r *http.Request, auth *WebAuth) error {
+	if !webOriginAllowed(r) {
+		return fmt.Errorf("origin %s not allowed", r.Header.Get("Origin"))
+	}
+	if auth.authenticatesEachRequest(r) || len(r.Header.Get(api_script_header_)) > 0 {
+		return nil
+	}
+	token := r.Header.Get(csrf_header_)
+	cookie, err := r.Cookie(csrf_cookie_name_)
+	if err != nil || len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return fmt.Errorf("send header %s with the value of cookie %s, or %s if you are a script", csrf_header_, csrf_cookie_name_, api_script_header_)
+	}
+	return nil
+}
+
+// parses requests/duration, e.g. 120/1m. A client may use them all at once, then has to wait for more. 0 means no limit
+func parseRateLimit(spec string) (rateLimit, error) {
+	if spec == "0" || spec == "off" {
+		return rateLimit{}, nil
+	}
+	nd := strings.SplitN(spec, "/", 2)
+	if len(nd) != 2 {
+		return rateLimit{}, fmt.Errorf("%s is not requests/duration", spec)
+	}
+	n, err := strconv.Atoi(nd[0])
+	if err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid number of requests %s", nd[0])
+	}
+	per, err := time.ParseDuration(nd[1])
+	if err != nil || per <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid duration %s", nd[1])
+	}
+	return rateLimit{rate: float64(n) / per.Seconds(), burst: float64(n)}, nil
+}
+
+// GOMQTTWEBFRONT_RATELIMIT, see parseRateLimit
+func NewIPRateLimiter(spec, ipheader string) (*ipRateLimiter, error) {
+	limit, err := parseRateLimit(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &ipRateLimiter{limit: limit, ipheader: ipheader, buckets: make(map[string]*list.Element, 50), recent: list.New()}, nil
+}
+
+func newTokenBucket(limit rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: limit.burst, last: now}
+}
+
+// takes a token if there is one, otherwise tells how long until there is
+func (b *tokenBucket) take(now time.Time, limit rateLimit) (bool, time.Duration) {
+	if limit.rate <= 0 {
+		return true, 0
+	}
+	b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+}
+
+// the address r came from, or the one our reverse proxy says it came from. Anybody else could put any address into the header
+func (l *ipRateLimiter) clientIP(r *http.Request) string {
+	if len(l.ipheader) > 0 && fromTrustedProxy(r) {
+		if ip := strings.TrimSpace(strings.Split(r.Header.Get(l.ipheader), ",")[0]); len(ip) > 0 {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Once we track ip_rate_limiter_max_buckets_ clients, the one we haven't heard from the longest is forgotten.
+// Somebody cycling through addresses thus at worst gives others a full bucket again, and never grows our memory
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	if l.limit.rate <= 0 {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	elem, inmap := l.buckets[ip]
+	if inmap {
+		l.recent.MoveToFront(elem)
+	} else {
+		if l.recent.Len() >= ip_rate_limiter_max_buckets_ {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*ipBucket).ip)
+		}
+		elem = l.recent.PushFront(&ipBucket{ip: ip, bucket: *newTokenBucket(l.limit, now)})
+		l.buckets[ip] = elem
+	}
+	return elem.Value.(*ipBucket).bucket.take(now, l.limit)
+}
+
+// answers 429 to clients sending more requests than l allows
+func webLimitPerIP(next http.Handler, l *ipRateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.clientIP(r)
+		if ok, wait := l.allow(ip); !ok {
+			LogWS_.Printf("RateLimit: too many requests from %s", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		want  rateLimit
+		valid bool
+	}{
+		{"120/1m", rateLimit{rate: 2, burst: 120}, true},
+		{"10/1s", rateLimit{rate: 10, burst: 10}, true},
+		{"0", rateLimit{}, true},
+		{"off", rateLimit{}, true},
+		{"120", rateLimit{}, false},
+		{"0/1m", rateLimit{}, false},
+		{"-1/1m", rateLimit{}, false},
+		{"10/0s", rateLimit{}, false},
+		{"10/soon", rateLimit{}, false},
+	} {
+		got, err := parseRateLimit(tc.spec)
+		if (err == nil) != tc.valid {
+			t.Errorf("parseRateLimit(%q): err %v, want valid %v", tc.spec, err, tc.valid)
+		} else if got != tc.want {
+			t.Errorf("parseRateLimit(%q) = %+v, want %+v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := rateLimit{rate: 2, burst: 3}
+	start := time.Unix(1000, 0)
+	bucket := newTokenBucket(limit, start)
+	for _, tc := range []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{10 * time.Second, true, 0},
+		{10 * time.Second, true, 0},
+		{10 * time.Second, true, 0},
+		{10 * time.Second, false, 500 * time.Millisecond},
+	} {
+		ok, wait := bucket.take(start.Add(tc.after), limit)
+		if ok != tc.ok || wait != tc.wait {
+			t.Errorf("take after %s = %v, %s, want %v, %s", tc.after, ok, wait, tc.ok, tc.wait)
+		}
+	}
+	if ok, _ := newTokenBucket(rateLimit{}, start).take(start, rateLimit{}); !ok {
+		t.Error("no limit must always allow")
+	}
+}
+
+func TestIPRateLimiterForgetsLeastRecentlySeen(t *testing.T) {
+	limiter, err := NewIPRateLimiter("1/1h", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := limiter.allow("10.0.0.1"); !ok {
+		t.Fatal("first request of 10.0.0.1 refused")
+	}
+	if ok, _ := limiter.allow("10.0.0.1"); ok {
+		t.Fatal("second request of 10.0.0.1 allowed")
+	}
+	if ok, _ := limiter.allow("10.0.0.2"); !ok {
+		t.Fatal("first request of 10.0.0.2 refused")
+	}
+	for idx := 0; idx < ip_rate_limiter_max_buckets_-1; idx++ {
+		limiter.allow(fmt.Sprintf("192.168.%d.%d", idx/256, idx%256))
+		if idx == 0 {
+			limiter.allow("10.0.0.2") //seen again, 10.0.0.1 is now the oldest
+		}
+	}
+	if len(limiter.buckets) != ip_rate_limiter_max_buckets_ || limiter.recent.Len() != ip_rate_limiter_max_buckets_ {
+		t.Fatalf("tracking %d/%d clients, want at most %d", len(limiter.buckets), limiter.recent.Len(), ip_rate_limiter_max_buckets_)
+	}
+	if _, inmap := limiter.buckets["10.0.0.1"]; inmap {
+		t.Error("10.0.0.1 was the least recently seen and should have been forgotten")
+	}
+	if ok, _ := limiter.allow("10.0.0.2"); ok {
+		t.Error("10.0.0.2 was seen recently and should still be limited")
+	}
+}
+
+func TestClientIPHeaderOnlyFromTrustedProxy(t *testing.T) {
+	defer SetTrustedProxies(DEFAULT_GOMQTTWEBFRONT_TRUSTEDPROXIES)
+	if err := SetTrustedProxies("127.0.0.1,10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := NewIPRateLimiter("120/1m", "X-Real-IP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remote, header, want string
+	}{
+		{"127.0.0.1:4711", "203.0.113.7", "203.0.113.7"},
+		{"10.1.2.3:4711", "203.0.113.7, 10.1.2.3", "203.0.113.7"},
+		{"127.0.0.1:4711", "", "127.0.0.1"},
+		{"192.168.33.5:4711", "203.0.113.7", "192.168.33.5"},
+		{"[2001:db8::1]:4711", "203.0.113.7", "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if len(tc.header) > 0 {
+			r.Header.Set("X-Real-IP", tc.header)
+		}
+		if got := limiter.clientIP(r); got != tc.want {
+			t.Errorf("clientIP from %s with %q = %s, want %s", tc.remote, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestAPICheckCSRF(t *testing.T) {
+	defer SetTrustedProxies(DEFAULT_GOMQTTWEBFRONT_TRUSTEDPROXIES)
+	if err := SetTrustedProxies("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	noauth := &WebAuth{mode: AuthNone}
+	passwdauth := &WebAuth{mode: AuthPasswordFile}
+	proxyauth := &WebAuth{mode: AuthProxyHeader, proxyheader: "X-Remote-User"}
+	for _, tc := range []struct {
+		name    string
+		auth    *WebAuth
+		remote  string
+		headers map[string]string
+		cookies map[string]string
+		ok      bool
+	}{
+		{"no token", noauth, "192.168.33.5:4711", nil, nil, false},
+		{"script header", noauth, "192.168.33.5:4711", map[string]string{"X-Requested-With": "curl"}, nil, true},
+		{"token", noauth, "192.168.33.5:4711", map[string]string{"X-CSRF-Token": "t0k3n"}, map[string]string{csrf_cookie_name_: "t0k3n"}, true},
+		{"wrong token", noauth, "192.168.33.5:4711", map[string]string{"X-CSRF-Token": "guess"}, map[string]string{csrf_cookie_name_: "t0k3n"}, false},
+		{"foreign origin", noauth, "192.168.33.5:4711", map[string]string{"X-Requested-With": "curl", "Origin": "https://evil.example"}, nil, false},
+		{"session cookie", passwdauth, "192.168.33.5:4711", nil, map[string]string{session_cookie_name_: "s3ss10n"}, false},
+		{"session cookie and token", passwdauth, "192.168.33.5:4711", map[string]string{"X-CSRF-Token": "t0k3n"}, map[string]string{session_cookie_name_: "s3ss10n", csrf_cookie_name_: "t0k3n"}, true},
+		{"basic auth", passwdauth, "192.168.33.5:4711", map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"}, nil, true},
+		{"basic auth with session cookie", passwdauth, "192.168.33.5:4711", map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"}, map[string]string{session_cookie_name_: "s3ss10n"}, false},
+		{"trusted proxy login", proxyauth, "127.0.0.1:4711", map[string]string{"X-Remote-User": "alice"}, nil, true},
+		{"untrusted proxy login", proxyauth, "192.168.33.5:4711", map[string]string{"X-Remote-User": "alice"}, nil, false},
+		{"proxy without login", proxyauth, "127.0.0.1:4711", nil, nil, false},
+	} {
+		r := httptest.NewRequest("PUT", "/api/v1/devices/rf/couchred", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		for k, v := range tc.cookies {
+			r.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+		if err := apiCheckCSRF(r, tc.auth); (err == nil) != tc.ok {
+			t.Errorf("%s: %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	shutdown_timeout_           = 10 * time.Second
+	mqtt_disconnect_quiesce_ms_ = 1000
+)
+
+func newShutdownStage(name string) *shutdownStage {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shutdownStage{name: name, ctx: ctx, cancel: cancel}
+}
+
+// runs f until the stage is stopped, unless it already is
+func (s *shutdownStage) Go(f func(ctx context.Context)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		f(s.ctx)
+	}()
+}
+
+// tells the goroutines of the stage to stop and waits for them, at most until deadline. false if they took too long
+func (s *shutdownStage) Stop(deadline context.Context) bool {
+	s.mutex.Lock()
+	s.stopped = true
+	s.cancel()
+	s.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		LogMain_.Printf("Shutdown: %s done", s.name)
+		return true
+	case <-deadline.Done():
+		LogMain_.Printf("Shutdown: %s did not finish in time", s.name)
+		return false
+	}
+}
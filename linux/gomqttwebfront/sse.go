@@ -0,0 +1,200 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sse_ring_len_           = 256 // events a client may miss and still resume with Last-Event-ID
+	sse_keepalive_interval_ = 20 * time.Second
+	sse_retry_ms_           = 3000
+)
+
+var sse_events_ = &sseEventLog{
+	boot:      strconv.FormatInt(time.Now().Unix(), 36),
+	ring:      make([]sseEvent, sse_ring_len_),
+	next:      1,
+	start:     1,
+	listeners: make(map[chan struct{}]bool, 10),
+}
+
+func (l *sseEventLog) wakeupLocked() {
+	for notify := range l.listeners {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (l *sseEventLog) append(ctx string, frame []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ring[l.next%sse_ring_len_] = sseEvent{id: l.next, ctx: ctx, frame: frame}
+	l.next++
+	l.wakeupLocked()
+}
+
+// we missed updates, so nobody may resume from before now. Skips an id so even clients that were up to date notice
+func (l *sseEventLog) resync() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.next++
+	l.start = l.next
+	l.wakeupLocked()
+}
+
+func (l *sseEventLog) subscribe() chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	notify := make(chan struct{}, 1)
+	l.listeners[notify] = true
+	return notify
+}
+
+func (l *sseEventLog) unsubscribe(notify chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.listeners, notify)
+}
+
+// id of the last event
+func (l *sseEventLog) last() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.next - 1
+}
+
+// events after lastid. ok is false if some of them are gone and the client needs the full state again
+func (l *sseEventLog) since(lastid uint64) (events []sseEvent, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	oldest := l.start
+	if l.next > sse_ring_len_ && l.next-sse_ring_len_ > oldest {
+		oldest = l.next - sse_ring_len_
+	}
+	if lastid+1 < oldest || lastid >= l.next {
+		return nil, false
+	}
+	events = make([]sseEvent, 0, l.next-lastid-1)
+	for id := lastid + 1; id < l.next; id++ {
+		events = append(events, l.ring[id%sse_ring_len_])
+	}
+	return events, true
+}
+
+func (l *sseEventLog) eventId(id uint64) string {
+	return l.boot + "-" + strconv.FormatUint(id, 10)
+}
+
+// id from Last-Event-ID, if it is one of ours from since we started
+func (l *sseEventLog) parseEventId(eventid string) (uint64, bool) {
+	idx := strings.LastIndexByte(eventid, '-')
+	if idx < 0 || eventid[:idx] != l.boot {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(eventid[idx+1:], 10, 64)
+	return id, err == nil
+}
+
+// handles requests to /events, streaming what websocket clients get as Server-Sent Events.
+// Each event's data is one frame {"ctx":...,"data":...}, beginning with the device list and last known states
+func webHandleSSE(ctx context.Context, w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture, auth *WebAuth) {
+	flusher, canflush := w.(http.Flusher)
+	if !canflush {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := ctxPatternsFromQuery(r, "ctx")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := auth.UserFor(r) //like websocket clients, checked once on connect
+	wanted := func(ctx string) bool {
+		if !Devices().MayRead(user.Role, ctx) {
+			return false
+		}
+		for _, pattern := range filter {
+			if ctxMatches(pattern, ctx) {
+				return true
+			}
+		}
+		return len(filter) == 0
+	}
+
+	//listen before we take the snapshot, so the client misses nothing in between
+	notify := sse_events_.subscribe()
+	defer sse_events_.unsubscribe(notify)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") //tells nginx not to buffer us
+	w.WriteHeader(http.StatusOK)
+
+	var werr error
+	writeEvent := func(id uint64, frame []byte) {
+		if werr == nil {
+			_, werr = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", sse_events_.eventId(id), frame)
+		}
+	}
+	sendSnapshot := func() uint64 {
+		cursor := sse_events_.last()
+		for _, frame := range wsClientStateFrames(retained_json_chan) {
+			if wanted(frameCtx(frame)) {
+				writeEvent(cursor, frame)
+			}
+		}
+		return cursor
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", sse_retry_ms_)
+	cursor, resume := sse_events_.parseEventId(r.Header.Get("Last-Event-ID"))
+	if resume {
+		_, resume = sse_events_.since(cursor)
+	}
+	if resume {
+		LogWS_.Println("SSE client resumed", r.RemoteAddr, cursor)
+		select {
+		case notify <- struct{}{}: //send what it missed right away
+		default:
+		}
+	} else {
+		LogWS_.Println("SSE client connected", r.RemoteAddr, user.Name)
+		cursor = sendSnapshot()
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sse_keepalive_interval_)
+	defer keepalive.Stop()
+	for werr == nil {
+		select {
+		case <-r.Context().Done():
+			werr = r.Context().Err()
+		case <-ctx.Done():
+			werr = fmt.Errorf("shutting down")
+		case <-notify:
+			events, ok := sse_events_.since(cursor)
+			if !ok {
+				cursor = sendSnapshot()
+			}
+			for _, ev := range events {
+				if wanted(ev.ctx) {
+					writeEvent(ev.id, ev.frame)
+				}
+				cursor = ev.id
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			_, werr = fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+	LogWS_.Println("SSE client gone", r.RemoteAddr, werr)
+}
@@ -0,0 +1,77 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_GOMQTTWEBFRONT_STATECACHE string = "gomqttwebfront_state.json"
+	statecache_save_interval_                = 5 * time.Minute
+	stale_check_interval_                    = time.Minute
+)
+
+// device kind -> how long without news until we call its state stale
+var stale_after_ = make(map[string]time.Duration, 4)
+
+// e.g. "zigbee2mqtt:25h,fancy:2h"
+func SetStaleAfter(spec string) error {
+	for _, kindafter := range strings.Split(spec, ",") {
+		if len(strings.TrimSpace(kindafter)) == 0 {
+			continue
+		}
+		kd := strings.SplitN(strings.TrimSpace(kindafter), ":", 2)
+		if len(kd) != 2 {
+			return fmt.Errorf("%s is not kind:duration", kindafter)
+		}
+		if _, knownkind := device_kind_default_schema_[kd[0]]; !knownkind {
+			return fmt.Errorf("unknown Kind %s", kd[0])
+		}
+		after, err := time.ParseDuration(kd[1])
+		if err != nil || after <= 0 {
+			return fmt.Errorf("invalid duration %s for %s", kd[1], kd[0])
+		}
+		stale_after_[kd[0]] = after
+	}
+	return nil
+}
+
+// tells if we haven't heard from the device behind ctx for longer than its kind allows
+func isStale(ctx string, cached CachedState, now time.Time) bool {
+	dev, inmap := Devices().ByTopic(ctx)
+	if !inmap {
+		return false
+	}
+	after, inmap := stale_after_[dev.Kind]
+	return inmap && now.Sub(time.Unix(cached.Ts, 0)) > after
+}
+
+func stateFrame(ctx string, cached CachedState, stale bool) ([]byte, error) {
+	return json.Marshal(wsMessage{Ctx: ctx, Data: cached.Data, Ts: cached.Ts, Source: cached.Source, Stale: stale})
+}
+
+func LoadStateCache(filename string) (map[string]CachedState, error) {
+	states := make(map[string]CachedState, 100)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return states, nil
+	} else if err != nil {
+		return states, err
+	}
+	return states, json.Unmarshal(data, &states)
+}
+
+// Remembers the last state of every ctx for the next start. Runs every statecache_save_interval_ and on shutdown,
+// which is when systemd may kill us halfway, so the file is replaced whole or not at all
+func SaveStateCache(filename string, states map[string]CachedState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data, 0644)
+}
@@ -1,11 +1,26 @@
 // (c) Bernhard Tittelbach 2017
 package main
 
-import "github.com/realraum/door_and_sensors/r3events"
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
 
 type wsMessage struct {
-	Ctx  string      `json:"ctx"`
-	Data interface{} `json:"data"`
+	Ctx    string      `json:"ctx"`
+	Data   interface{} `json:"data"`
+	Id     string      `json:"id,omitempty"`     // chosen by the client, returned in replies to its request
+	Ts     int64       `json:"ts,omitempty"`     // when we received it, unix seconds
+	Source string      `json:"source,omitempty"` // retained, live or echo of our own publish
+	Stale  bool        `json:"stale,omitempty"`  // from before our restart or older than the kind's GOMQTTWEBFRONT_STALEAFTER, may have changed since
 }
 
 type HSV struct {
@@ -21,6 +36,38 @@ type AdvFancyLightSettings struct {
 	HSV            *HSV   `json:"hsv"`
 }
 
+// how much brighter than red a color appears, to calibrate conversions from HSV and white balance
+type LEDFactors struct {
+	R  float64 `json:"r_factor"`
+	G  float64 `json:"g_factor"`
+	B  float64 `json:"b_factor"`
+	WW float64 `json:"ww_factor"`
+	CW float64 `json:"cw_factor"`
+}
+
+type dawnDuskFollower struct {
+	name    string
+	follow  bool
+	setting AdvFancyLightSettings
+	expect  r3events.FancyLight
+}
+
+type dawnDuskFollowing struct {
+	setting   AdvFancyLightSettings
+	optedin   bool                // from circadian config, suspend instead of forget
+	suspended time.Time           // zero while following
+	expect    r3events.FancyLight // what we last sent
+}
+
+type CircadianConfig struct {
+	Lights      []string
+	WIntensity  int64
+	Fade        string // e.g. "2m", defaults to the update interval
+	ResumeAfter string // e.g. "4h", empty to stay suspended until told to follow again
+	fade        time.Duration
+	resumeafter time.Duration
+}
+
 type wsMsgFancyLight struct {
 	Name       string                 `json:"name"`
 	Setting    *r3events.FancyLight   `json:"setting,omitempty"`
@@ -54,6 +101,273 @@ type RFCmdToSend struct {
 }
 
 type MQTTOutboundMsg struct {
-	topic string
-	msg   interface{}
+	topic       string
+	msg         interface{}
+	onpublished func(error) // optional, called once publishing completed or failed
+	by          string      // optional web user, GoLightCtrl names are then published below topic_golightctrl_by_web_pre_
+}
+
+type WebUser struct {
+	Name string `json:"user"`
+	Role string `json:"role"`
+}
+
+type passwdEntry struct {
+	hash []byte
+	role string
+}
+
+type webSession struct {
+	user    WebUser
+	expires time.Time
+}
+
+type WebAuth struct {
+	mode         string
+	passwdfile   string
+	passwd       map[string]passwdEntry
+	passwd_mtime int64
+	proxyheader  string
+	anonymous    WebUser
+	sessions     map[string]*webSession
+	basicauth    map[string]basicAuthEntry // by user name
+	mutex        sync.Mutex
+}
+
+type basicAuthEntry struct {
+	user    WebUser
+	sum     [sha256.Size]byte // of name:password
+	expires time.Time
+}
+
+// checks data sent by a web client for ctx and returns what to publish. Must not change anything, the command may still be refused
+type wsCtxValidator func(ctx string, data interface{}) (wsValidCommand, error)
+
+type wsValidCommand struct {
+	payload   []byte
+	followsun *dawnDuskFollower // fancy lights, for goFollowDawnDusk once the command is published
+}
+
+type DeviceConfig struct {
+	Name              string
+	Kind              string   // fancy, basic, sonoff, esphome, zigbee2mqtt, rf or other
+	Topic             string   `json:",omitempty"` // short for StateTopic and CommandTopic being the same
+	StateTopic        string   `json:",omitempty"`
+	CommandTopic      string   `json:",omitempty"`
+	SendOnConnect     bool     `json:",omitempty"` // last state is sent to clients on connect
+	Guest             bool     `json:",omitempty"` // guests may send to CommandTopic, not only members
+	Schema            string   `json:",omitempty"` // validator for CommandTopic, defaults by Kind. Without, CommandTopic is read-only
+	Members           []string `json:",omitempty"` // CommandTopics this one sets all at once, e.g. ceilingAll
+	ShowAs            string   `json:",omitempty"` // ctx clients see StateTopic as, e.g. for old names of the same light
+	AvailabilityTopic string   `json:",omitempty"` // online status with last will, defaults by Kind for fancy, sonoff and esphome
+	//haswitch and halight, usually from Home Assistant discovery
+	Discovery       string   `json:",omitempty"` // discovery config topic the device came from
+	Capabilities    []string `json:",omitempty"` // brightness, color, color_temp
+	PayloadOn       string   `json:",omitempty"`
+	PayloadOff      string   `json:",omitempty"`
+	BrightnessScale int64    `json:",omitempty"`
+	MinMireds       int64    `json:",omitempty"`
+	MaxMireds       int64    `json:",omitempty"`
+}
+
+type haDiscoveredDevice struct {
+	topic  string
+	device *DeviceConfig // nil once removed
+}
+
+// what we use of a Home Assistant MQTT discovery config, after expanding abbreviations
+type haDiscoveryConfig struct {
+	Name                string   `json:"name"`
+	UniqueId            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic"`
+	CommandTopic        string   `json:"command_topic"`
+	Schema              string   `json:"schema"`
+	PayloadOn           string   `json:"payload_on"`
+	PayloadOff          string   `json:"payload_off"`
+	Brightness          bool     `json:"brightness"`
+	BrightnessScale     int64    `json:"brightness_scale"`
+	RGB                 bool     `json:"rgb"`
+	ColorTemp           bool     `json:"color_temp"`
+	SupportedColorModes []string `json:"supported_color_modes"`
+	MinMireds           int64    `json:"min_mireds"`
+	MaxMireds           int64    `json:"max_mireds"`
+}
+
+type DeviceRegistryConfig struct {
+	Devices []DeviceConfig
+}
+
+type DeviceRegistry struct {
+	devices        []DeviceConfig
+	byname         map[string]*DeviceConfig // kind/name
+	bytopic        map[string]*DeviceConfig
+	topics         []string
+	sendonconnect  []string
+	allowed        map[string][]string // role -> command topics
+	memberonly     map[string]bool     // ctx of devices only members may send to, which only they may read
+	validators     map[string]wsCtxValidator
+	atomize        map[string][]string
+	byavailability map[string][]*DeviceConfig
+}
+
+// tells a client what happened to its request: accepted, rejected, published or failed
+type wsReply struct {
+	Id     string `json:"id,omitempty"`
+	Ctx    string `json:"ctx"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// a device and what we know about it, as the REST API returns it
+type apiDeviceState struct {
+	Device DeviceConfig    `json:"device"`
+	Online *bool           `json:"online,omitempty"` // unless the device never told us
+	State  json.RawMessage `json:"state"`            // last frame {"ctx":...,"data":...,"ts":...} or null
+}
+
+// fancy lights also take uv for lights that have uv leds
+// and advanced settings, that we convert into r,g,b,ww,cw
+type wsFancyLightSetting struct {
+	r3events.FancyLight
+	AdvFancyLightSettings
+	UV *uint16 `json:"uv,omitempty"`
+}
+
+type esphomeLightCommand struct {
+	State      *string  `json:"state,omitempty"`
+	Brightness *int64   `json:"brightness,omitempty"`
+	ColorTemp  *int64   `json:"color_temp,omitempty"`
+	WhiteValue *int64   `json:"white_value,omitempty"`
+	Transition *float64 `json:"transition,omitempty"`
+	Flash      *string  `json:"flash,omitempty"`
+	Effect     *string  `json:"effect,omitempty"`
+	Color      *struct {
+		R *int64 `json:"r,omitempty"`
+		G *int64 `json:"g,omitempty"`
+		B *int64 `json:"b,omitempty"`
+	} `json:"color,omitempty"`
+}
+
+type zigbee2mqttSetCommand struct {
+	State      *string  `json:"state,omitempty"`
+	Brightness *int64   `json:"brightness,omitempty"`
+	ColorTemp  *int64   `json:"color_temp,omitempty"`
+	Transition *float64 `json:"transition,omitempty"`
+}
+
+type wsQueuedFrame struct {
+	frame []byte
+	since time.Time // when the client first had something pending for this ctx
+}
+
+// what still needs to be sent to one websocket client. Only the latest frame per ctx is kept
+type wsClientQueue struct {
+	remote  string
+	role    string // of the user, decides what it may read
+	pending map[string]wsQueuedFrame
+	order   []string
+	resync  bool // we dropped something, client needs the full state again
+	notify  chan struct{}
+	mutex   sync.Mutex
+	//ctx patterns the client subscribed to, nil until it does, which means everything
+	subscriptions map[string]bool
+}
+
+type wsClientList struct {
+	clients map[*wsClientQueue]bool
+	mutex   sync.RWMutex
+}
+
+type sseEvent struct {
+	id    uint64
+	ctx   string
+	frame []byte
+}
+
+// the last few frames sent to websocket clients, so SSE clients can resume where they left off
+type sseEventLog struct {
+	boot      string // tells ids from before a restart apart
+	ring      []sseEvent
+	next      uint64 // id of the next event
+	start     uint64 // oldest id we still know all events since
+	listeners map[chan struct{}]bool
+	mutex     sync.Mutex
+}
+
+// last state of a ctx, as kept on disk across restarts
+type CachedState struct {
+	Data   json.RawMessage
+	Ts     int64
+	Source string
+}
+
+type mqttOwnPublish struct {
+	payload []byte
+	ts      time.Time
+}
+
+// one step of shutting down. Its goroutines stop taking new work once ctx is done, finish what is queued and return
+type shutdownStage struct {
+	name    string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	stopped bool
+	mutex   sync.Mutex
+}
+
+const (
+	webServePlain = iota
+	webServeTLS
+	webServeRedirect // plain HTTP, sending everybody to https
+)
+
+type webListener struct {
+	listener net.Listener
+	mode     int
+}
+
+// serves the certificate from certfile and keyfile, re-read once they change
+type tlsCertReloader struct {
+	certfile  string
+	keyfile   string
+	certmtime int64
+	keymtime  int64
+	cert      *tls.Certificate
+	mutex     sync.RWMutex
+}
+
+type rateLimit struct {
+	rate  float64 // tokens per second, 0 for no limit
+	burst float64
+}
+
+// refills at some rate up to a burst, each request takes one token
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	limit    rateLimit
+	ipheader string                   // tells the client's address if we are behind a reverse proxy
+	buckets  map[string]*list.Element // of *ipBucket in recent
+	recent   *list.List               // most recently seen client first, at most ip_rate_limiter_max_buckets_
+	mutex    sync.Mutex
+}
+
+type ipBucket struct {
+	ip     string
+	bucket tokenBucket
+}
+
+// commands from web clients waiting for MQTT. Only the newest per ctx is kept, each ctx may send as often as limit allows
+type webCommandQueue struct {
+	order   []string // ctx in the order they were first queued
+	pending map[string]MQTTOutboundMsg
+	buckets map[string]*tokenBucket
+	limit   rateLimit
+	notify  chan struct{}
+	closed  bool
+	mutex   sync.Mutex
 }
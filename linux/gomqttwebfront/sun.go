@@ -0,0 +1,54 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_GOMQTTWEBFRONT_LATITUDE  = "47.0654"
+	DEFAULT_GOMQTTWEBFRONT_LONGITUDE = "15.4502"
+	sun_elevation_night_             = -6.0 //civil twilight, reddish warm below
+	sun_elevation_day_               = 30.0 //coldwhite above
+)
+
+var latitude_, longitude_ float64
+
+// where we are, to know where the sun is
+func SetLocation(latitude, longitude string) error {
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil || lat < -90.0 || lat > 90.0 {
+		return fmt.Errorf("invalid latitude %s", latitude)
+	}
+	lon, err := strconv.ParseFloat(longitude, 64)
+	if err != nil || lon < -180.0 || lon > 180.0 {
+		return fmt.Errorf("invalid longitude %s", longitude)
+	}
+	latitude_, longitude_ = lat, lon
+	return nil
+}
+
+func degToRad(deg float64) float64 { return deg * math.Pi / 180.0 }
+func radToDeg(rad float64) float64 { return rad * 180.0 / math.Pi }
+
+// elevation of the sun above the horizon in degrees, NOAA approximation, good to about a degree
+func SunElevation(ts time.Time, latitude, longitude float64) float64 {
+	ts = ts.UTC()
+	gamma := 2 * math.Pi / 365.0 * (float64(ts.YearDay()-1) + (float64(ts.Hour())-12)/24.0)
+	eqtime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) - 0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) - 0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) - 0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+	truesolarminutes := float64(ts.Hour()*60+ts.Minute()) + float64(ts.Second())/60.0 + eqtime + 4*longitude
+	hourangle := degToRad(truesolarminutes/4.0 - 180.0)
+	lat := degToRad(latitude)
+	coszenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourangle)
+	return 90.0 - radToDeg(math.Acos(math.Max(-1.0, math.Min(1.0, coszenith))))
+}
+
+// maps the sun position at our location onto WBalance [-500..500]
+func WBalanceFromSun(ts time.Time) int64 {
+	elevation := math.Max(sun_elevation_night_, math.Min(sun_elevation_day_, SunElevation(ts, latitude_, longitude_)))
+	return int64(math.Round(-500.0 + 1000.0*(elevation-sun_elevation_night_)/(sun_elevation_day_-sun_elevation_night_)))
+}
@@ -2,7 +2,10 @@
 
 package main
 
-import "os"
+import (
+	"io/ioutil"
+	"os"
+)
 
 func getFileMTime(filename string) (int64, error) {
 	keysfile, err := os.Open(filename)
@@ -41,3 +44,13 @@ func stringInSlice(a string, list []string) bool {
 	}
 	return false
 }
+
+// replaces filename with data in one rename, so readers find either the old or the new content, never a mix
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpfilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpfilename, data, perm); err != nil {
+		os.Remove(tmpfilename)
+		return err
+	}
+	return os.Rename(tmpfilename, filename)
+}
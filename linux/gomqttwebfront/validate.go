@@ -0,0 +1,364 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/realraum/door_and_sensors/r3events"
+)
+
+const (
+	max_scene_name_len_    = 64
+	max_script_name_len_   = 42
+	max_ircmd_name_len_    = 42
+	max_esphome_transition = 3600.0
+)
+
+// validation schemas devices may use in the registry
+var ws_schemas_ map[string]wsCtxValidator
+
+func init() {
+	ws_schemas_ = map[string]wsCtxValidator{
+		"fancylight":  validateFancyLight,
+		"pipeleds":    payloadOnly(validatePipeLedPattern),
+		"yamaha":      payloadOnly(validateYamahaIRCmd),
+		"sonoff":      payloadOnly(validateSonoffPower),
+		"esphome":     payloadOnly(validateESPHomeCommand),
+		"zigbee2mqtt": payloadOnly(validateZigbee2MQTTSet),
+		"lightctrl":   payloadOnly(validateLightCtrlAction),
+		"scene":       payloadOnly(validateSceneCmd),
+		"script":      payloadOnly(validateActivateScript),
+		"haswitch":    payloadOnly(validateHASwitch),
+		"halight":     payloadOnly(validateHALight),
+	}
+}
+
+// for validators whose commands need nothing but publishing
+func payloadOnly(validator func(ctx string, data interface{}) ([]byte, error)) wsCtxValidator {
+	return func(ctx string, data interface{}) (wsValidCommand, error) {
+		payload, err := validator(ctx, data)
+		return wsValidCommand{payload: payload}, err
+	}
+}
+
+// every ctx a client may send to needs a validator, everything else is read-only
+func ValidateWSPayload(ctx string, data interface{}) (wsValidCommand, error) {
+	validator, inmap := Devices().Validator(ctx)
+	if !inmap {
+		return wsValidCommand{}, fmt.Errorf("%s is read-only", ctx)
+	}
+	return validator(ctx, data)
+}
+
+// call once cmd made it to MQTT
+func (cmd wsValidCommand) published() {
+	if cmd.followsun != nil {
+		followDawnDusk(*cmd.followsun)
+	}
+}
+
+// decodes generic json data into v, refusing fields v does not know
+func decodeStrict(data interface{}, v interface{}) error {
+	jsonbytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(jsonbytes))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func checkRange(name string, value *int64, min, max int64) error {
+	if value != nil && (*value < min || *value > max) {
+		return fmt.Errorf("%s not in valid range [%d..%d]", name, min, max)
+	}
+	return nil
+}
+
+func checkOnOffToggle(state *string) error {
+	if state == nil {
+		return nil
+	}
+	switch *state {
+	case "ON", "OFF", "TOGGLE":
+		return nil
+	}
+	return fmt.Errorf("state must be ON, OFF or TOGGLE")
+}
+
+func validateFancyLight(ctx string, data interface{}) (wsValidCommand, error) {
+	var setting wsFancyLightSetting
+	if err := decodeStrict(data, &setting); err != nil {
+		return wsValidCommand{}, err
+	}
+	name := fancyLightName(ctx)
+	adv := &setting.AdvFancyLightSettings
+	if !adv.isSet() {
+		adv = nil
+	}
+	if err := SanityCheckWSFancyLight(&wsMsgFancyLight{Name: name, Setting: &setting.FancyLight, AdvSetting: adv}); err != nil {
+		return wsValidCommand{}, err
+	}
+	if setting.UV != nil && *setting.UV > 1000 {
+		return wsValidCommand{}, fmt.Errorf("UV not in valid range [0..1000]")
+	}
+	fl := setting.FancyLight
+	if adv != nil {
+		if fl.R != nil || fl.G != nil || fl.B != nil || fl.WW != nil || fl.CW != nil {
+			return wsValidCommand{}, fmt.Errorf("use either r,g,b,ww,cw or hsv,wintensity,wbalance,followdawndusk")
+		}
+		if adv.HSV == nil && adv.WIntensity == nil && adv.WBalance == nil && !*adv.FollowDawnDusk {
+			return wsValidCommand{}, fmt.Errorf("followdawndusk false needs a setting to switch to")
+		}
+		converted := ConvertAdvFancyLightSettings(name, adv)
+		fl.R, fl.G, fl.B, fl.WW, fl.CW = converted.R, converted.G, converted.B, converted.WW, converted.CW
+	}
+	payload, err := json.Marshal(struct {
+		r3events.FancyLight
+		UV *uint16 `json:"uv,omitempty"`
+	}{fl, setting.UV})
+	//any setting that does not ask to follow the sun stops following it
+	followsun := newDawnDuskFollower(name, adv, fl)
+	return wsValidCommand{payload: payload, followsun: &followsun}, err
+}
+
+func validatePipeLedPattern(ctx string, data interface{}) ([]byte, error) {
+	var pattern r3events.SetPipeLEDsPattern
+	if err := decodeStrict(data, &pattern); err != nil {
+		return nil, err
+	}
+	if err := SanityCheckPipeLedPattern(&pattern); err != nil {
+		return nil, err
+	}
+	return json.Marshal(pattern)
+}
+
+func validateYamahaIRCmd(ctx string, data interface{}) ([]byte, error) {
+	var ircmd r3events.YamahaIRCmd
+	if err := decodeStrict(data, &ircmd); err != nil {
+		return nil, err
+	}
+	if len(ircmd.Cmd) == 0 || len(ircmd.Cmd) > max_ircmd_name_len_ || strings.ContainsAny(ircmd.Cmd, "/+#!? ") {
+		return nil, fmt.Errorf("invalid Cmd")
+	}
+	return json.Marshal(ircmd)
+}
+
+func validateSonoffPower(ctx string, data interface{}) ([]byte, error) {
+	power, isstring := data.(string)
+	if !isstring {
+		return nil, fmt.Errorf("expected \"on\", \"off\" or \"toggle\"")
+	}
+	power = strings.ToUpper(power)
+	if err := checkOnOffToggle(&power); err != nil {
+		return nil, err
+	}
+	return []byte(power), nil
+}
+
+func validateESPHomeCommand(ctx string, data interface{}) ([]byte, error) {
+	var cmd esphomeLightCommand
+	if err := decodeStrict(data, &cmd); err != nil {
+		return nil, err
+	}
+	if err := checkOnOffToggle(cmd.State); err != nil {
+		return nil, err
+	}
+	for _, err := range []error{
+		checkRange("brightness", cmd.Brightness, 0, 255),
+		checkRange("color_temp", cmd.ColorTemp, 153, 500),
+		checkRange("white_value", cmd.WhiteValue, 0, 255),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Color != nil {
+		for _, err := range []error{checkRange("color.r", cmd.Color.R, 0, 255), checkRange("color.g", cmd.Color.G, 0, 255), checkRange("color.b", cmd.Color.B, 0, 255)} {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cmd.Transition != nil && (*cmd.Transition < 0 || *cmd.Transition > max_esphome_transition) {
+		return nil, fmt.Errorf("transition not in valid range [0..%.0f]", max_esphome_transition)
+	}
+	if cmd.Flash != nil && *cmd.Flash != "short" && *cmd.Flash != "long" {
+		return nil, fmt.Errorf("flash must be short or long")
+	}
+	return json.Marshal(cmd)
+}
+
+func validateZigbee2MQTTSet(ctx string, data interface{}) ([]byte, error) {
+	var cmd zigbee2mqttSetCommand
+	if err := decodeStrict(data, &cmd); err != nil {
+		return nil, err
+	}
+	if err := checkOnOffToggle(cmd.State); err != nil {
+		return nil, err
+	}
+	if err := checkRange("brightness", cmd.Brightness, 0, 254); err != nil {
+		return nil, err
+	}
+	if err := checkRange("color_temp", cmd.ColorTemp, 150, 500); err != nil {
+		return nil, err
+	}
+	if cmd.Transition != nil && (*cmd.Transition < 0 || *cmd.Transition > max_esphome_transition) {
+		return nil, fmt.Errorf("transition not in valid range [0..%.0f]", max_esphome_transition)
+	}
+	return json.Marshal(cmd)
+}
+
+// GoLightCtrl names take "on", "off", "send" or {"Action":...} with the same values or 0/1
+func validateLightCtrlAction(ctx string, data interface{}) ([]byte, error) {
+	action := data
+	if obj, isobj := data.(map[string]interface{}); isobj {
+		if len(obj) != 1 {
+			return nil, fmt.Errorf("expected {\"Action\":...}")
+		}
+		action = obj["Action"]
+	}
+	switch a := action.(type) {
+	case string:
+		if a == "on" || a == "off" || a == "send" {
+			if _, isstring := data.(string); isstring {
+				return []byte(a), nil
+			}
+			return json.Marshal(data)
+		}
+	case float64:
+		if a == 0 || a == 1 {
+			return json.Marshal(data)
+		}
+	}
+	return nil, fmt.Errorf("Action must be on, off, send, 0 or 1")
+}
+
+func validateSceneCmd(ctx string, data interface{}) ([]byte, error) {
+	var cmd r3events.LightCtrlActionOnName
+	if err := decodeStrict(data, &cmd); err != nil {
+		return nil, err
+	}
+	if len(cmd.Name) == 0 || len(cmd.Name) > max_scene_name_len_ || strings.ContainsAny(cmd.Name, "/+#") {
+		return nil, fmt.Errorf("invalid scene name")
+	}
+	if cmd.Action != "save" && cmd.Action != "restore" && cmd.Action != "delete" {
+		return nil, fmt.Errorf("Action must be save, restore or delete")
+	}
+	return json.Marshal(cmd)
+}
+
+// scripts take all kinds of arguments, we only check the ones all of them share
+func validateActivateScript(ctx string, data interface{}) ([]byte, error) {
+	obj, isobj := data.(map[string]interface{})
+	if !isobj {
+		return nil, fmt.Errorf("expected {\"script\":...}")
+	}
+	script, isstring := obj["script"].(string)
+	if !isstring || len(script) == 0 || len(script) > max_script_name_len_ || strings.ContainsAny(script, "/+#!? ") {
+		return nil, fmt.Errorf("invalid script")
+	}
+	if value, inmap := obj["value"]; inmap {
+		if v, isnumber := value.(float64); !isnumber || v < 0.0 || v > 1.0 {
+			return nil, fmt.Errorf("value must be in range [0..1.0]")
+		}
+	}
+	if participating, inmap := obj["participating"]; inmap {
+		names, islist := participating.([]interface{})
+		if !islist {
+			return nil, fmt.Errorf("participating must be a list")
+		}
+		for _, name := range names {
+			if _, isstring := name.(string); !isstring {
+				return nil, fmt.Errorf("participating must be a list of names")
+			}
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// discovered switches take "on", "off", true or false and get their payload_on or payload_off
+func validateHASwitch(ctx string, data interface{}) ([]byte, error) {
+	dev, inmap := Devices().ByTopic(ctx)
+	if !inmap {
+		return nil, fmt.Errorf("unknown device")
+	}
+	on, off := IfThenElseStr(len(dev.PayloadOn) > 0, dev.PayloadOn, "ON"), IfThenElseStr(len(dev.PayloadOff) > 0, dev.PayloadOff, "OFF")
+	switch d := data.(type) {
+	case bool:
+		return []byte(IfThenElseStr(d, on, off)), nil
+	case string:
+		switch strings.ToLower(d) {
+		case "on", strings.ToLower(on):
+			return []byte(on), nil
+		case "off", strings.ToLower(off):
+			return []byte(off), nil
+		}
+	}
+	return nil, fmt.Errorf("expected \"on\" or \"off\"")
+}
+
+// discovered json schema lights take what they announced they can do
+func validateHALight(ctx string, data interface{}) ([]byte, error) {
+	dev, inmap := Devices().ByTopic(ctx)
+	if !inmap {
+		return nil, fmt.Errorf("unknown device")
+	}
+	var cmd esphomeLightCommand
+	if err := decodeStrict(data, &cmd); err != nil {
+		return nil, err
+	}
+	if cmd.State != nil && *cmd.State != "ON" && *cmd.State != "OFF" {
+		return nil, fmt.Errorf("state must be ON or OFF")
+	}
+	if cmd.Brightness != nil {
+		if !stringInSlice("brightness", dev.Capabilities) {
+			return nil, fmt.Errorf("%s has no brightness", dev.Name)
+		}
+		scale := dev.BrightnessScale
+		if scale <= 0 {
+			scale = 255
+		}
+		if err := checkRange("brightness", cmd.Brightness, 0, scale); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.ColorTemp != nil {
+		if !stringInSlice("color_temp", dev.Capabilities) {
+			return nil, fmt.Errorf("%s has no color_temp", dev.Name)
+		}
+		minmireds, maxmireds := dev.MinMireds, dev.MaxMireds
+		if minmireds <= 0 {
+			minmireds = 153
+		}
+		if maxmireds <= 0 {
+			maxmireds = 500
+		}
+		if err := checkRange("color_temp", cmd.ColorTemp, minmireds, maxmireds); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Color != nil {
+		if !stringInSlice("color", dev.Capabilities) {
+			return nil, fmt.Errorf("%s has no color", dev.Name)
+		}
+		for _, err := range []error{checkRange("color.r", cmd.Color.R, 0, 255), checkRange("color.g", cmd.Color.G, 0, 255), checkRange("color.b", cmd.Color.B, 0, 255)} {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cmd.WhiteValue != nil || cmd.Effect != nil {
+		return nil, fmt.Errorf("white_value and effect are not supported")
+	}
+	if cmd.Transition != nil && (*cmd.Transition < 0 || *cmd.Transition > max_esphome_transition) {
+		return nil, fmt.Errorf("transition not in valid range [0..%.0f]", max_esphome_transition)
+	}
+	if cmd.Flash != nil && *cmd.Flash != "short" && *cmd.Flash != "long" {
+		return nil, fmt.Errorf("flash must be short or long")
+	}
+	return json.Marshal(cmd)
+}
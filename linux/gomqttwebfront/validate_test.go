@@ -0,0 +1,139 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var validate_test_devices_ = []DeviceConfig{
+	{Name: "ceiling1", Kind: DeviceFancy, Topic: "action/ceiling1/light"},
+	{Name: "couchred", Kind: DeviceSonoff, Topic: "action/couchred/POWER"},
+	{Name: "olgadecke", Kind: DeviceESPHome, Topic: "action/olgadecke/command"},
+	{Name: "bluebar", Kind: DeviceZigbee2MQTT, Topic: "zigbee2mqtt/w1/OutletBlueLEDBar/set"},
+	{Name: "allrf", Kind: DeviceRF, Topic: "action/GoLightCtrl/allrf"},
+	{Name: "ymh", Kind: DeviceOther, Topic: "action/yamahastereo/ircmd", Schema: "yamaha"},
+	{Name: "scene", Kind: DeviceOther, Topic: "action/GoLightCtrl/scene", Schema: "scene"},
+	{Name: "scenes", Kind: DeviceOther, StateTopic: "realraum/GoLightCtrl/scenes"},
+	{Name: "ceilingscripts", Kind: DeviceOther, Topic: "action/ceilingscripts/activatescript", Schema: "script"},
+	{Name: "plug", Kind: DeviceHASwitch, Topic: "ha/plug/set", PayloadOn: "1", PayloadOff: "0"},
+	{Name: "lamp", Kind: DeviceHALight, Topic: "ha/lamp/set", Capabilities: []string{"brightness"}, BrightnessScale: 100},
+}
+
+func TestValidateWSPayload(t *testing.T) {
+	reg, err := NewDeviceRegistry(validate_test_devices_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	olddevices := Devices()
+	setDevices(reg)
+	defer setDevices(olddevices)
+
+	for _, tc := range []struct {
+		ctx  string
+		data string
+		want string // empty if the payload must be refused
+	}{
+		{"realraum/GoLightCtrl/scenes", `"on"`, ""},
+		{"action/ceiling1/light", `{"r":1000,"g":0,"b":0,"ww":0,"cw":0}`, `{"r":1000,"g":0,"b":0,"cw":0,"ww":0}`},
+		{"action/ceiling1/light", `{"r":1001}`, ""},
+		{"action/ceiling1/light", `{"r":10,"hsv":{"h":0,"s":1,"v":1}}`, ""},
+		{"action/unknown/light", `"on"`, ""},
+		{"action/couchred/POWER", `"on"`, `ON`},
+		{"action/couchred/POWER", `"Toggle"`, `TOGGLE`},
+		{"action/couchred/POWER", `"blink"`, ""},
+		{"action/couchred/POWER", `1`, ""},
+		{"action/olgadecke/command", `{"state":"ON","brightness":255}`, `{"state":"ON","brightness":255}`},
+		{"action/olgadecke/command", `{"brightness":256}`, ""},
+		{"action/olgadecke/command", `{"color_temp":100}`, ""},
+		{"action/olgadecke/command", `{"color":{"r":0,"g":300,"b":0}}`, ""},
+		{"action/olgadecke/command", `{"transition":3601}`, ""},
+		{"action/olgadecke/command", `{"flash":"medium"}`, ""},
+		{"action/olgadecke/command", `{"state":"ON","explode":true}`, ""},
+		{"zigbee2mqtt/w1/OutletBlueLEDBar/set", `{"state":"OFF"}`, `{"state":"OFF"}`},
+		{"zigbee2mqtt/w1/OutletBlueLEDBar/set", `{"brightness":255}`, ""},
+		{"zigbee2mqtt/w1/OutletBlueLEDBar/set", `{"state":"on"}`, ""},
+		{"action/GoLightCtrl/allrf", `"on"`, `on`},
+		{"action/GoLightCtrl/allrf", `{"Action":"send"}`, `{"Action":"send"}`},
+		{"action/GoLightCtrl/allrf", `{"Action":1}`, `{"Action":1}`},
+		{"action/GoLightCtrl/allrf", `{"Action":2}`, ""},
+		{"action/GoLightCtrl/allrf", `{"Action":"on","Extra":1}`, ""},
+		{"action/GoLightCtrl/allrf", `"dim"`, ""},
+		{"action/yamahastereo/ircmd", `{"Cmd":"ymhpower"}`, `{"Cmd":"ymhpower","Ts":0}`},
+		{"action/yamahastereo/ircmd", `{"Cmd":"a/b"}`, ""},
+		{"action/yamahastereo/ircmd", `{"Cmd":""}`, ""},
+		{"action/GoLightCtrl/scene", `{"Name":"vortrag","Action":"restore"}`, `{"Name":"vortrag","Action":"restore"}`},
+		{"action/GoLightCtrl/scene", `{"Name":"vor#trag","Action":"restore"}`, ""},
+		{"action/GoLightCtrl/scene", `{"Name":"vortrag","Action":"rename"}`, ""},
+		{"action/ceilingscripts/activatescript", `{"script":"wave","value":0.5,"participating":["ceiling1"]}`, `{"participating":["ceiling1"],"script":"wave","value":0.5}`},
+		{"action/ceilingscripts/activatescript", `{"script":"wave","value":1.5}`, ""},
+		{"action/ceilingscripts/activatescript", `{"script":"rm -rf"}`, ""},
+		{"action/ceilingscripts/activatescript", `{"script":"wave","participating":[1]}`, ""},
+		{"action/ceilingscripts/activatescript", `"wave"`, ""},
+		{"ha/plug/set", `true`, `1`},
+		{"ha/plug/set", `"OFF"`, `0`},
+		{"ha/plug/set", `"0"`, `0`},
+		{"ha/plug/set", `"dim"`, ""},
+		{"ha/lamp/set", `{"state":"ON","brightness":100}`, `{"state":"ON","brightness":100}`},
+		{"ha/lamp/set", `{"brightness":101}`, ""},
+		{"ha/lamp/set", `{"color_temp":300}`, ""},
+		{"ha/lamp/set", `{"state":"TOGGLE"}`, ""},
+		{"ha/lamp/set", `{"effect":"rainbow"}`, ""},
+	} {
+		var data interface{}
+		if err := json.Unmarshal([]byte(tc.data), &data); err != nil {
+			t.Fatalf("%s %s: %s", tc.ctx, tc.data, err)
+		}
+		cmd, err := ValidateWSPayload(tc.ctx, data)
+		payload := cmd.payload
+		if len(tc.want) == 0 {
+			if err == nil {
+				t.Errorf("%s %s: accepted as %s, want refused", tc.ctx, tc.data, payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: refused with %s, want %s", tc.ctx, tc.data, err, tc.want)
+		} else if string(payload) != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.ctx, tc.data, payload, tc.want)
+		}
+	}
+}
+
+// only a published command may change whether a light follows the sun, so validating must leave that to the caller
+func TestValidateFancyLightFollowsSunOnlyOnceToldSo(t *testing.T) {
+	reg, err := NewDeviceRegistry(validate_test_devices_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	olddevices := Devices()
+	setDevices(reg)
+	defer setDevices(olddevices)
+
+	for _, tc := range []struct {
+		data   string
+		follow bool
+	}{
+		{`{"followdawndusk":true}`, true},
+		{`{"r":1000,"g":0,"b":0,"ww":0,"cw":0}`, false},
+	} {
+		var data interface{}
+		json.Unmarshal([]byte(tc.data), &data)
+		cmd, err := ValidateWSPayload("action/ceiling1/light", data)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.data, err)
+		}
+		select {
+		case f := <-follow_dawndusk_chan_:
+			t.Errorf("%s: validating told goFollowDawnDusk %+v", tc.data, f)
+		default:
+		}
+		if cmd.followsun == nil || cmd.followsun.name != "ceiling1" || cmd.followsun.follow != tc.follow {
+			t.Fatalf("%s: followsun %+v, want ceiling1 follow %v", tc.data, cmd.followsun, tc.follow)
+		}
+		cmd.published()
+		if f := <-follow_dawndusk_chan_; f.follow != tc.follow {
+			t.Errorf("%s: published told follow %v, want %v", tc.data, f.follow, tc.follow)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -10,216 +12,161 @@ import (
 	"strings"
 	"time"
 
-	"github.com/btittelbach/pubsub"
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/websocket"
 	"github.com/hexadecy/nocache"
 	"github.com/realraum/door_and_sensors/r3events"
 )
 
-var (
-	topics_other = []string{r3events.ACT_PIPELEDS_PATTERN, r3events.ACT_YAMAHA_SEND,
-		"action/GoLightCtrl/all",
-		"action/GoLightCtrl/allrf",
-		"action/GoLightCtrl/ambientlights",
-		"action/GoLightCtrl/ymhpoweroff",
-		"action/GoLightCtrl/ymhpower",
-		"action/GoLightCtrl/ymhpoweron",
-		"action/GoLightCtrl/ymhcd",
-		"action/GoLightCtrl/ymhtuner",
-		"action/GoLightCtrl/ymhtape",
-		"action/GoLightCtrl/ymhwdtv",
-		"action/GoLightCtrl/ymhsattv",
-		"action/GoLightCtrl/ymhvcr",
-		"action/GoLightCtrl/ymh7",
-		"action/GoLightCtrl/ymhaux",
-		"action/GoLightCtrl/ymhextdec",
-		"action/GoLightCtrl/ymhtest",
-		"action/GoLightCtrl/ymhtunabcde",
-		"action/GoLightCtrl/ymheffect",
-		"action/GoLightCtrl/ymhtunplus",
-		"action/GoLightCtrl/ymhtunminus",
-		"action/GoLightCtrl/ymhvolup",
-		"action/GoLightCtrl/ymhvoldown",
-		"action/GoLightCtrl/ymhvolmute",
-		"action/GoLightCtrl/ymhmenu",
-		"action/GoLightCtrl/ymhplus",
-		"action/GoLightCtrl/ymhminus",
-		"action/GoLightCtrl/ymhtimelevel",
-		"action/GoLightCtrl/ymhprgdown",
-		"action/GoLightCtrl/ymhprgup",
-		"action/GoLightCtrl/ymhsleep",
-		"action/GoLightCtrl/ymhp5",
-		"action/GoLightCtrl/bluebar",
-		"action/GoLightCtrl/couchwhite",
-		"action/GoLightCtrl/couchred",
-		"action/GoLightCtrl/abwasch",
-		"action/GoLightCtrl/cxleds",
-		"action/GoLightCtrl/spots",
-		"action/GoLightCtrl/regalleinwand",
-		"action/GoLightCtrl/labortisch",
-		"action/GoLightCtrl/floodtesla",
-		"action/GoLightCtrl/laserball",
-		"action/GoLightCtrl/logo",
-		"action/GoLightCtrl/boilerolga",
-		"action/GoLightCtrl/fancyvortrag",
-		"action/ceilingscripts/activatescript"}
-	topic_fancy_ceiling_all    = "action/ceilingAll/light"
-	topic_basic_ceiling_all    = "action/GoLightCtrl/basiclightAll"
-	topic_oldbasic_ceiling_all = "action/GoLightCtrl/ceilingAll"
-	topics_fancy_ceiling       = []string{
-		"action/ceiling1/light",
-		"action/ceiling2/light",
-		"action/ceiling3/light",
-		"action/ceiling4/light",
-		"action/ceiling5/light",
-		"action/ceiling6/light",
-		"action/abwasch/light",
-		"action/flooddoor/light",
-		"action/funkbude/light",
-	}
-	topics_basic_ceiling = []string{
-		"action/GoLightCtrl/basiclight1",
-		"action/GoLightCtrl/basiclight2",
-		"action/GoLightCtrl/basiclight3",
-		"action/GoLightCtrl/basiclight4",
-		"action/GoLightCtrl/basiclight5",
-		"action/GoLightCtrl/basiclight6",
-	}
-	topics_oldbasic_ceiling = []string{
-		"action/GoLightCtrl/ceiling1",
-		"action/GoLightCtrl/ceiling2",
-		"action/GoLightCtrl/ceiling3",
-		"action/GoLightCtrl/ceiling4",
-		"action/GoLightCtrl/ceiling5",
-		"action/GoLightCtrl/ceiling6",
-	}
-	topics_sonoff_action = []string{
-		"action/mashadecke/POWER",
-		"action/couchred/POWER",
-		"action/olgaboiler/POWER",
-		"action/lothrboiler/POWER",
-		"action/hallwaylight/POWER",
-		"action/r2w2whiteboard/POWER",
-		"action/twang/POWER",
-	}
-	topics_esphome_state = []string{
-		"realraum/olgadecke/state",
-		"realraum/subtable/state",
-	}
-	topics_esphome_command = []string{
-		"action/olgadecke/command",
-		"action/subtable/command",
-	}
-	topics_zigbee2mqtt_state = []string{
-		"zigbee2mqtt/w1/OutletBlueLEDBar",
-	}
-	topics_zigbee2mqtt_action = []string{
-		"zigbee2mqtt/w1/OutletBlueLEDBar/set",
-	}
-
-	ws_allowed_ctx_all = append(
-		append(
-			append(
-				append(
-					append(
-						append(
-							append(
-								append(
-									append(
-										append(
-											append(topics_other, topics_fancy_ceiling...),
-											topics_basic_ceiling...),
-										topics_oldbasic_ceiling...),
-									topic_basic_ceiling_all),
-								topic_fancy_ceiling_all),
-							topic_oldbasic_ceiling_all),
-						topics_sonoff_action...),
-					topics_esphome_command...),
-				topics_esphome_state...),
-			topics_zigbee2mqtt_state...),
-		topics_zigbee2mqtt_action...)
-	ws_allowed_ctx_sendtoclientonconnect = append(append(append(append(append(topics_other, topics_fancy_ceiling...), topics_basic_ceiling...), topics_sonoff_action...), topics_esphome_state...), topics_zigbee2mqtt_state...)
-)
-
 const (
-	ws_ping_period_      = time.Duration(58) * time.Second
-	ws_read_timeout_     = time.Duration(70) * time.Second // must be > than ws_ping_period_
-	ws_write_timeout_    = time.Duration(9) * time.Second
-	ws_max_message_size_ = int64(512)
+	ws_ctx_reply_         = "reply"
+	ws_ctx_devices_       = "devices"
+	ws_status_accepted_   = "accepted"
+	ws_status_rejected_   = "rejected"
+	ws_status_published_  = "published"
+	ws_status_failed_     = "failed"
+	ws_status_busy_       = "busy"       // not queued, try again later
+	ws_status_superseded_ = "superseded" // a newer command for the same ctx was sent instead
+	ws_ping_period_       = time.Duration(58) * time.Second
+	ws_read_timeout_      = time.Duration(70) * time.Second // must be > than ws_ping_period_
+	ws_write_timeout_     = time.Duration(9) * time.Second
+	ws_max_message_size_  = int64(512)
+	ws_ctx_batch_         = "batch"
+	ws_source_retained_   = "retained"
+	ws_source_live_       = "live"
+	ws_source_echo_       = "echo"
+	ws_protocol_batch_    = "r3batch.v2"          // clients asking for this subprotocol get updates batched in {"ctx":"batch","data":[{ctx,data},...]}
+	ws_batch_window_      = 50 * time.Millisecond // how long we collect updates before sending a batch
+	ws_reply_queue_len_   = 128                   // a client using up all of GOMQTTWEBFRONT_WSCMDLIMIT at once gets two replies per command
 )
 
-var wsupgrader = websocket.Upgrader{} // use default options with Origin Check
+var wsupgrader = websocket.Upgrader{Subprotocols: []string{ws_protocol_batch_}, CheckOrigin: webOriginAllowed}
 
-//Atomizing because we take a CeilingAll msg and split it and send on its parts Ceiling1 .. Ceiling9
-func goAtomizeCeilingAll(ps_ *pubsub.PubSub, atomized_wsout_chan chan<- wsMessage) {
-	shutdown_chan := ps_.SubOnce(PS_SHUTDOWN)
-	msgtoall_chan := ps_.Sub(PS_WEBSOCK_ALL)
-	defer ps_.Unsub(msgtoall_chan, PS_WEBSOCK_ALL)
-	sendnonblockingToAtomizedWSOutChan := func(wsmsg wsMessage) {
-		select {
-		case atomized_wsout_chan <- wsmsg: //just pointer. should be ok to use webmsg.Data multiple times since we never change single bytes
-		default:
-			LogWS_.Printf("ERROR: goAtomizeCeilingAll can't write to full atomized_wsout_chan")
-		}
+// one frame holding many, for clients speaking ws_protocol_batch_. Frames are already marshalled wsMessages
+func wsBatchFrame(frames [][]byte) []byte {
+	batch := make([]byte, 0, 32+len(frames)*100)
+	batch = append(batch, `{"ctx":"`+ws_ctx_batch_+`","data":[`...)
+	batch = append(batch, bytes.Join(frames, []byte{','})...)
+	return append(batch, ']', '}')
+}
+
+//Atomizing because we take a CeilingAll msg and split it and send on its parts Ceiling1 .. Ceiling9, as the device registry says
+func atomizeCeilingAll(webmsg wsMessage) []wsMessage {
+	//groups like ceilingAll become their members, old names become new ones
+	ctxs, atomize := Devices().Atomize(webmsg.Ctx)
+	if !atomize {
+		return []wsMessage{webmsg}
 	}
-	for {
-		select {
-		case <-shutdown_chan:
-			return
-		case webmsg_i := <-msgtoall_chan:
-			if webmsg, castok := webmsg_i.(wsMessage); castok {
-			SWITCHCTX:
-				switch webmsg.Ctx {
-				case topic_fancy_ceiling_all:
-					for _, tp := range topics_fancy_ceiling {
-						sendnonblockingToAtomizedWSOutChan(wsMessage{Ctx: tp, Data: webmsg.Data}) //just pointer. should be ok to use webmsg.Data multiple times since we never change single bytes
-					}
-				case topic_basic_ceiling_all:
-					for _, tp := range topics_basic_ceiling {
-						sendnonblockingToAtomizedWSOutChan(wsMessage{Ctx: tp, Data: webmsg.Data}) //just pointer. should be ok to use webmsg.Data multiple times since we never change single bytes
-					}
-				case topic_oldbasic_ceiling_all:
-					for _, tp := range topics_basic_ceiling { //convert oldbasic to new basic
-						sendnonblockingToAtomizedWSOutChan(wsMessage{Ctx: tp, Data: webmsg.Data}) //just pointer. should be ok to use webmsg.Data multiple times since we never change single bytes
-					}
-				default:
-					for idx, topicmatch := range topics_oldbasic_ceiling {
-						if webmsg.Ctx == topicmatch {
-							sendnonblockingToAtomizedWSOutChan(wsMessage{topics_basic_ceiling[idx], webmsg.Data})
-							break SWITCHCTX
-						}
-					}
-					sendnonblockingToAtomizedWSOutChan(webmsg)
-				}
-			}
-		}
+	atomized := make([]wsMessage, len(ctxs))
+	for idx, tp := range ctxs {
+		atomized[idx] = wsMessage{Ctx: tp, Data: webmsg.Data} //just pointer. should be ok to use webmsg.Data multiple times since we never change single bytes
 	}
-
+	return atomized
 }
 
 // glue-code that repackages updates as json
 // It is here so we can rewrite the json output format for the webserver if we want
 // AND so that conversion to JSON is done only once for every connected websocket
-func goJSONMarshalStuffForWebSockClientsAndRetain(getretained_chan chan JsonFuture) {
+// AND so that the last states survive a restart in statecachefile
+func goJSONMarshalStuffForWebSockClientsAndRetain(getretained_chan chan JsonFuture, statecachefile string) {
 	shutdown_chan := ps_.SubOnce(PS_SHUTDOWN)
-	atomized_wsout_chan := make(chan wsMessage, 400)
-	retained_json_map := make(map[string][]byte, len(ws_allowed_ctx_sendtoclientonconnect))
+	msgtoall_chan := ps_.Sub(PS_WEBSOCK_ALL)
+	defer ps_.Unsub(msgtoall_chan, PS_WEBSOCK_ALL)
+	retained_json_map := make(map[string][]byte, len(Devices().SendOnConnect()))
+	save_ticker := time.NewTicker(statecache_save_interval_)
+	defer save_ticker.Stop()
 
-	go goAtomizeCeilingAll(ps_, atomized_wsout_chan) //subscribes to PS_WEBSOCK_ALL and gives us possibly replaced wsMessage structs
+	//until a fresh message arrives, clients get the cached state marked as stale
+	cached_states, err := LoadStateCache(statecachefile)
+	if err != nil {
+		LogWS_.Printf("goJSONMarshalStuffForWebSockClientsAndRetain: can't load %s: %s", statecachefile, err)
+	}
+	stale_ctx := make(map[string]bool, len(cached_states))
+	for ctx, cached := range cached_states {
+		if webjson, err := stateFrame(ctx, cached, true); err == nil {
+			retained_json_map[ctx] = webjson
+			stale_ctx[ctx] = true
+		}
+	}
+	stale_ticker := time.NewTicker(stale_check_interval_)
+	defer stale_ticker.Stop()
+	cache_dirty := false
+	saveStateCache := func() error {
+		if !cache_dirty {
+			return nil
+		}
+		if err := SaveStateCache(statecachefile, cached_states); err != nil {
+			LogWS_.Printf("goJSONMarshalStuffForWebSockClientsAndRetain: can't save %s: %s", statecachefile, err)
+			return err
+		}
+		cache_dirty = false
+		return nil
+	}
 
 	for {
 		select {
 		case <-shutdown_chan:
+			saveStateCache()
 			return
 
-		case webmsg := <-atomized_wsout_chan:
-			LogWS_.Println("goJSONMarshalStuffForWebSockClientsAndRetain", webmsg)
-			if webjson, err := json.Marshal(webmsg); err == nil {
-				ps_.Pub(webjson, PS_WEBSOCK_ALL_JSON)
+		case <-save_ticker.C:
+			saveStateCache()
+
+		case saved_c := <-statecache_save_chan_:
+			saved_c <- saveStateCache()
+
+		case now := <-stale_ticker.C:
+			//tell clients about devices we haven't heard from in a while
+			for ctx, cached := range cached_states {
+				if stale_ctx[ctx] || !isStale(ctx, cached, now) {
+					continue
+				}
+				stale_ctx[ctx] = true
+				if webjson, err := stateFrame(ctx, cached, true); err == nil {
+					retained_json_map[ctx] = webjson
+					ws_clients_.broadcast(ctx, webjson)
+					sse_events_.append(ctx, webjson)
+				}
+			}
+
+		case webmsg_i, isopen := <-msgtoall_chan:
+			if !isopen {
+				//PubNonBlocking unsubscribed us because we were too slow, so everybody missed something
+				LogWS_.Print("goJSONMarshalStuffForWebSockClientsAndRetain: missed updates, resubscribing and resyncing clients")
+				msgtoall_chan = ps_.Sub(PS_WEBSOCK_ALL)
+				ws_clients_.resyncAll()
+				sse_events_.resync()
+				continue
+			}
+			webmsg_orig, castok := webmsg_i.(wsMessage)
+			if !castok {
+				continue
+			}
+			for _, webmsg := range atomizeCeilingAll(webmsg_orig) {
+				LogWS_.Println("goJSONMarshalStuffForWebSockClientsAndRetain", webmsg)
+				var webjson []byte
+				if webmsg.Ctx == ws_ctx_devices_ || webmsg.Ctx == ws_ctx_availability_ {
+					webjson, err = json.Marshal(webmsg)
+				} else {
+					//device states are remembered with when and how we got them
+					var data []byte
+					if data, err = json.Marshal(webmsg.Data); err == nil {
+						if webmsg.Ts == 0 {
+							webmsg.Ts = time.Now().Unix()
+						}
+						cached_states[webmsg.Ctx] = CachedState{Data: data, Ts: webmsg.Ts, Source: webmsg.Source}
+						cache_dirty = true
+						delete(stale_ctx, webmsg.Ctx)
+						webjson, err = stateFrame(webmsg.Ctx, cached_states[webmsg.Ctx], false)
+					}
+				}
+				if err != nil {
+					LogWS_.Println(err)
+					continue
+				}
 				retained_json_map[webmsg.Ctx] = webjson
-			} else {
-				LogWS_.Println(err)
+				ws_clients_.broadcast(webmsg.Ctx, webjson)
+				sse_events_.append(webmsg.Ctx, webjson)
 			}
 
 		case f := <-getretained_chan:
@@ -248,28 +195,78 @@ func goJSONMarshalStuffForWebSockClientsAndRetain(getretained_chan chan JsonFutu
 	}
 }
 
+// device list and last known states, what a client gets on connect and when resynced
+func wsClientStateFrames(retained_json_chan chan JsonFuture) [][]byte {
+	frames := make([][]byte, 0, len(Devices().SendOnConnect())+1)
+	if devicelist, err := json.Marshal(wsMessage{Ctx: ws_ctx_devices_, Data: Devices().devices}); err == nil {
+		frames = append(frames, devicelist)
+	}
+	what := append([]string{ws_ctx_availability_}, Devices().SendOnConnect()...)
+	ourfuture := make(chan OurFutures, 2)
+	retained_json_chan <- JsonFuture{future: ourfuture, omitempty: true, what: what}
+	return append(frames, <-ourfuture...)
+}
+
 // goroutine responsible for talking TO a websocket client connected to /sock
-func goWriteToClient(ws *websocket.Conn) {
-	shutdown_c := ps_.SubOnce(PS_SHUTDOWN)
-	udpate_c := ps_.Sub(PS_WEBSOCK_ALL_JSON)
+func goWriteToClient(ctx context.Context, ws *websocket.Conn, queue *wsClientQueue, reply_c <-chan []byte, retained_json_chan chan JsonFuture) {
 	ticker := time.NewTicker(ws_ping_period_)
-	defer ps_.Unsub(udpate_c, PS_WEBSOCK_ALL_JSON)
+	defer ticker.Stop()
+	batching := ws.Subprotocol() == ws_protocol_batch_
+	var batch_c <-chan time.Time //set while we collect updates for a batch
+	writeFrames := func(frames [][]byte) bool {
+		if batching && len(frames) > 1 {
+			frames = [][]byte{wsBatchFrame(frames)}
+		}
+		for _, frame := range frames {
+			ws.SetWriteDeadline(time.Now().Add(ws_write_timeout_))
+			if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+				LogWS_.Println("goWriteToClient", ws.RemoteAddr(), "Error", err)
+				return false
+			}
+		}
+		return true
+	}
+	//false if the client is gone or too slow
+	writeQueued := func() bool {
+		frames, resync, lag := queue.popAll()
+		if lag > ws_client_max_lag_ {
+			LogWS_.Println("goWriteToClient", ws.RemoteAddr(), "stays behind by", lag, "disconnecting")
+			ws.SetWriteDeadline(time.Now().Add(ws_write_timeout_))
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+			ws.Close()
+			return false
+		}
+		if resync {
+			LogWS_.Println("goWriteToClient", ws.RemoteAddr(), "dropped messages, resyncing")
+			frames = append(queue.filterFrames(wsClientStateFrames(retained_json_chan)), frames...)
+		}
+		return writeFrames(frames)
+	}
 	for {
 		select {
-		case <-shutdown_c:
+		case <-ctx.Done():
 			ws.SetWriteDeadline(time.Now().Add(ws_write_timeout_))
-			ws.WriteMessage(websocket.CloseMessage, []byte{})
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"))
+			//the client answers with a close frame, which ends the read loop. We don't wait long for it
+			ws.SetReadDeadline(time.Now().Add(time.Second))
 			return
-		case jsonupdate, isopen := <-udpate_c:
-			if !isopen {
-				ws.SetWriteDeadline(time.Now().Add(ws_write_timeout_))
-				ws.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-queue.notify:
+			if batching {
+				if batch_c == nil {
+					batch_c = time.After(ws_batch_window_)
+				}
+				continue
+			}
+			if !writeQueued() {
 				return
 			}
-			ws.SetWriteDeadline(time.Now().Add(ws_write_timeout_))
-			if err := ws.WriteMessage(websocket.TextMessage, jsonupdate.([]byte)); err != nil {
-				LogWS_.Println("goWriteToClient", ws.RemoteAddr(), "Error", err)
-				ps_.Unsub(shutdown_c, "shutdown")
+		case <-batch_c:
+			batch_c = nil
+			if !writeQueued() {
+				return
+			}
+		case reply := <-reply_c:
+			if !writeFrames([][]byte{reply}) {
 				return
 			}
 		case <-ticker.C:
@@ -338,9 +335,18 @@ func SanityCheckPipeLedPattern(data *r3events.SetPipeLEDsPattern) error {
 	return nil
 }
 
+func wsReplyFrame(request wsMessage, status string, err error) []byte {
+	reply := wsReply{Id: request.Id, Ctx: request.Ctx, Status: status}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	frame, _ := json.Marshal(wsMessage{Ctx: ws_ctx_reply_, Data: reply})
+	return frame
+}
+
 // handles requests to /cgi-bin/switch.cgi and accepts GET/POST Fields "Ctx" and "Data"
 // returns json formated state of Everything
-func webHandleCGICtxData(w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture) {
+func webHandleCGICtxData(w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture, auth *WebAuth) {
 	defer func() {
 		if x := recover(); x != nil {
 			LogWS_.Println("webHandleCGISwitch", x)
@@ -351,20 +357,54 @@ func webHandleCGICtxData(w http.ResponseWriter, r *http.Request, retained_json_c
 		return
 	}
 
+	webSetCSRFCookie(w, r)
+
 	ctx_a, ctx_inmap := r.Form["Ctx"]
 	data_a, data_inmap := r.Form["Data"]
 
 	if ctx_inmap && data_inmap && ctx_a != nil && data_a != nil && len(ctx_a) == 1 && len(data_a) == 1 {
 		ctx := ctx_a[0]
-		if stringInSlice(ctx, ws_allowed_ctx_all) {
-			//TODO: sanity check json payload that goes from web to MQTT
-			//TODO: then sanity check specific structs
-			MQTT_sendmsg_chan_ <- MQTTOutboundMsg{topic: ctx, msg: data_a[0]}
+		if !Devices().Known(ctx) {
+			http.Error(w, fmt.Sprintf("unknown ctx %s", ctx), http.StatusBadRequest)
+			return
+		}
+		//only our own page may switch, not any other page our users visit
+		if !webCheckCSRF(w, r) {
+			return
+		}
+		user := auth.UserFor(r)
+		auditLogSend(user, r, ctx, data_a[0], user.MaySend(ctx))
+		if !user.MaySend(ctx) {
+			http.Error(w, fmt.Sprintf("%s may not send to %s", user.Name, ctx), http.StatusForbidden)
+			return
+		}
+		var data interface{}
+		if err := json.Unmarshal([]byte(data_a[0]), &data); err != nil {
+			data = data_a[0] //not json, e.g. sonoff ON/OFF
+		}
+		cmd, err := ValidateWSPayload(ctx, data)
+		if err != nil {
+			LogWS_.Printf("webHandleCGICtxData %s: invalid payload: %s", ctx, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := CheckDeviceOnline(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err := web_commands_.enqueue(MQTTOutboundMsg{topic: ctx, msg: cmd.payload, by: auth.PublishAs(user), onpublished: func(err error) {
+			if err == nil {
+				cmd.published()
+			}
+		}}); err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
 	}
 
 	ourfuture := make(chan OurFutures, 2)
-	retained_json_chan <- JsonFuture{future: ourfuture, omitempty: true, what: ws_allowed_ctx_sendtoclientonconnect}
+	retained_json_chan <- JsonFuture{future: ourfuture, omitempty: true, what: Devices().SendOnConnect()}
 	futures := <-ourfuture
 	w.Write([]byte{'['})
 	w.Write(bytes.Join(futures, []byte{','}))
@@ -375,30 +415,56 @@ func webHandleCGICtxData(w http.ResponseWriter, r *http.Request, retained_json_c
 // handles requests to /sock WebSocket
 // following ctx are handled:
 // "switch": {name:..., action:...}
-func webHandleWebSocket(w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture) {
+func webHandleWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, retained_json_chan chan JsonFuture, auth *WebAuth) {
+	user := auth.UserFor(r) //session is checked once, on connect
+	//clients may subscribe right away with /sock?subscribe=pattern,... so they don't get the state of everything first
+	subscriptions, err := ctxPatternsFromQuery(r, ws_ctx_subscribe_)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ws, err := wsupgrader.Upgrade(w, r, nil)
 	if err != nil {
 		LogWS_.Println(err)
 		return
 	}
-	LogWS_.Println("Client connected", ws.RemoteAddr())
+	defer ws.Close()
+	LogWS_.Println("Client connected", ws.RemoteAddr(), user.Name)
 
-	//send client the inital known states
-	ourfuture := make(chan OurFutures, 2)
-	retained_json_chan <- JsonFuture{future: ourfuture, omitempty: true, what: ws_allowed_ctx_sendtoclientonconnect}
-	for _, f := range <-ourfuture {
+	//queue updates before we fetch the inital state, so the client misses nothing in between
+	queue := newWSClientQueue(ws.RemoteAddr().String(), user.Role)
+	if len(subscriptions) > 0 {
+		queue.subscribe(subscriptions)
+	}
+	ws_clients_.add(queue)
+	defer ws_clients_.remove(queue)
+	//send client the devices we know and their inital known states
+	initial := queue.filterFrames(wsClientStateFrames(retained_json_chan))
+	if ws.Subprotocol() == ws_protocol_batch_ {
+		initial = [][]byte{wsBatchFrame(initial)}
+	}
+	for _, f := range initial {
 		ws.WriteMessage(websocket.TextMessage, f)
 	}
 	//2nd goroutine per client that handles async push info
 	//e.g. sends updates about CeilingLight states and maybe about RF Send Actions
 	// IMPORTANT: After this function runs, WE (THIS FUNCTION) should no longer use ws.WriteMessage(..)
-	go goWriteToClient(ws)
+	reply_c := make(chan []byte, ws_reply_queue_len_)
+	sendReply := func(reply []byte) {
+		select {
+		case reply_c <- reply:
+		default:
+			LogWS_.Println("webHandleWebSocket", ws.RemoteAddr(), "dropping reply")
+		}
+	}
+	go goWriteToClient(ctx, ws, queue, reply_c, retained_json_chan)
 
 	ws.SetReadLimit(ws_max_message_size_)
 	ws.SetReadDeadline(time.Now().Add(ws_read_timeout_))
 	// the PongHandler will set the read deadline for next messages if pings arrive
 	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(ws_read_timeout_)); return nil })
 
+	commands := newTokenBucket(ws_command_limit_, time.Now())
 	for {
 		var v wsMessage
 		err := ws.ReadJSON(&v)
@@ -408,26 +474,77 @@ func webHandleWebSocket(w http.ResponseWriter, r *http.Request, retained_json_ch
 					LogWS_.Printf("webHandleWebSocket Error: %v", err)
 				}
 				break
-			} else if err, ok := err.(net.Error); ok && err.Timeout() {
-				LogWS_.Printf("goChatWithClientAboutCardList Timeout: %v", err)
+			} else if neterr, ok := err.(net.Error); ok {
+				if neterr.Timeout() {
+					LogWS_.Printf("goChatWithClientAboutCardList Timeout: %v", err)
+				} else {
+					LogWS_.Printf("webHandleWebSocket connection Error: %v", err) //e.g. goWriteToClient closed it on a slow client
+				}
 				break
 			} else {
 				LogWS_.Printf("webHandleWebSocket nonfatal Error: %v", err)
+				sendReply(wsReplyFrame(v, ws_status_rejected_, err))
+				continue
 			}
 		}
 		LogWS_.Printf("webHandleWebSocket Gotmsg: %+v", v)
-		if stringInSlice(v.Ctx, ws_allowed_ctx_all) {
-			//TODO: sanity check json payload that goes from web to MQTT
-			//TODO: then sanity check specific structs
-			// if err = SanityCheckWSFancyLight(&data); err != nil {
-			// 	LogWS_.Printf("%s Error during SanityCheckWSFancyLight: %s", v.Ctx, err)
-			// 	continue
-			// }
-			// if err := SanityCheckPipeLedPattern(&data); err != nil {
-			// 	LogWS_.Printf("%s Error during SanityCheckPipeLedPattern: %s", v.Ctx, err)
-			// 	continue
-			// }
-			MQTT_sendmsg_chan_ <- MQTTOutboundMsg{topic: v.Ctx, msg: v.Data}
+		if ok, _ := commands.take(time.Now(), ws_command_limit_); !ok {
+			sendReply(wsReplyFrame(v, ws_status_busy_, errCommandRateLimit))
+			continue
+		}
+		if v.Ctx == ws_ctx_subscribe_ || v.Ctx == ws_ctx_unsubscribe_ {
+			patterns, err := parseCtxPatterns(v.Data)
+			if err == nil && v.Ctx == ws_ctx_subscribe_ {
+				err = queue.subscribe(patterns)
+			} else if err == nil {
+				err = queue.unsubscribe(patterns)
+			}
+			if err != nil {
+				sendReply(wsReplyFrame(v, ws_status_rejected_, err))
+				continue
+			}
+			if v.Ctx == ws_ctx_subscribe_ {
+				//like retained messages in MQTT, the client gets the last state of what it now subscribed to
+				queue.pushMatching(wsClientStateFrames(retained_json_chan), patterns)
+			}
+			sendReply(wsReplyFrame(v, ws_status_accepted_, nil))
+		} else if Devices().Known(v.Ctx) {
+			auditLogSend(user, r, v.Ctx, v.Data, user.MaySend(v.Ctx))
+			if !user.MaySend(v.Ctx) {
+				sendReply(wsReplyFrame(v, ws_status_rejected_, fmt.Errorf("%s may not send to %s", user.Name, v.Ctx)))
+				continue
+			}
+			cmd, err := ValidateWSPayload(v.Ctx, v.Data)
+			if err != nil {
+				LogWS_.Printf("webHandleWebSocket %s: invalid payload: %s", v.Ctx, err)
+				sendReply(wsReplyFrame(v, ws_status_rejected_, err))
+				continue
+			}
+			if err := CheckDeviceOnline(v.Ctx); err != nil {
+				sendReply(wsReplyFrame(v, ws_status_rejected_, err))
+				continue
+			}
+			request := v
+			err = web_commands_.enqueue(MQTTOutboundMsg{topic: v.Ctx, msg: cmd.payload, by: auth.PublishAs(user), onpublished: func(err error) {
+				if err == nil {
+					cmd.published()
+				}
+				if err == errCommandSuperseded {
+					sendReply(wsReplyFrame(request, ws_status_superseded_, nil))
+				} else if err != nil {
+					LogWS_.Printf("webHandleWebSocket %s: publish failed: %s", request.Ctx, err)
+					sendReply(wsReplyFrame(request, ws_status_failed_, err))
+				} else {
+					sendReply(wsReplyFrame(request, ws_status_published_, nil))
+				}
+			}})
+			if err != nil {
+				sendReply(wsReplyFrame(v, ws_status_busy_, err))
+				continue
+			}
+			sendReply(wsReplyFrame(v, ws_status_accepted_, nil))
+		} else {
+			sendReply(wsReplyFrame(v, ws_status_rejected_, fmt.Errorf("unknown ctx %s", v.Ctx)))
 		}
 	}
 	LogWS_.Println("webHandleWebSocket terminating", ws.RemoteAddr())
@@ -444,7 +561,8 @@ func webRedirectToFallbackHTML(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func goRunWebserver() {
+// serves until ctx is done, then closes websocket and SSE clients and waits for requests in flight
+func goRunWebserver(ctx context.Context, auth *WebAuth) {
 	static := nocache.NoCacheStatic(negroni.NewStatic(http.Dir("public")))
 	negroni_recovery_on_panic := negroni.NewRecovery()
 	negroni_recovery_on_panic.PrintStack = false
@@ -453,18 +571,101 @@ func goRunWebserver() {
 	n := negroni.New(negroni_recovery_on_panic, logger, static)
 	// n := negroni.Classic() // Includes some default middlewares
 
+	if compress := EnvironOrDefault("GOMQTTWEBFRONT_WSCOMPRESSION", ""); compress == "true" || compress == "1" {
+		wsupgrader.EnableCompression = true //permessage-deflate, for clients that offer it
+	}
+	var err error
+	if ws_command_limit_, err = parseRateLimit(EnvironOrDefault("GOMQTTWEBFRONT_WSCMDLIMIT", DEFAULT_GOMQTTWEBFRONT_WSCMDLIMIT)); err != nil {
+		panic(fmt.Errorf("GOMQTTWEBFRONT_WSCMDLIMIT: %s", err))
+	}
+	if web_commands_.limit, err = parseRateLimit(EnvironOrDefault("GOMQTTWEBFRONT_DEVICECMDLIMIT", DEFAULT_GOMQTTWEBFRONT_DEVICECMDLIMIT)); err != nil {
+		panic(fmt.Errorf("GOMQTTWEBFRONT_DEVICECMDLIMIT: %s", err))
+	}
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		web_commands_.goForward(ctx, MQTT_sendmsg_chan_)
+	}()
 	retained_json_chan := make(chan JsonFuture, 20)
-	go goJSONMarshalStuffForWebSockClientsAndRetain(retained_json_chan)
+	go goJSONMarshalStuffForWebSockClientsAndRetain(retained_json_chan, EnvironOrDefault("GOMQTTWEBFRONT_STATECACHE", DEFAULT_GOMQTTWEBFRONT_STATECACHE))
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/sock", func(w http.ResponseWriter, r *http.Request) { webHandleWebSocket(w, r, retained_json_chan) })
-	mux.HandleFunc("/cgi-bin/fallback.cgi", func(w http.ResponseWriter, r *http.Request) { webHandleCGICtxData(w, r, retained_json_chan) })
+	mux.HandleFunc("/sock", func(w http.ResponseWriter, r *http.Request) { webHandleWebSocket(ctx, w, r, retained_json_chan, auth) })
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) { webHandleSSE(ctx, w, r, retained_json_chan, auth) })
+	mux.HandleFunc("/cgi-bin/fallback.cgi", func(w http.ResponseWriter, r *http.Request) { webHandleCGICtxData(w, r, retained_json_chan, auth) })
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) { webHandleLogin(w, r, auth) })
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) { webHandleLogout(w, r, auth) })
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) { webHandleWhoAmI(w, r, auth) })
+	mux.HandleFunc(api_prefix_, func(w http.ResponseWriter, r *http.Request) { webHandleAPI(w, r, retained_json_chan, auth) })
 	mux.HandleFunc("/cgi-bin/rfswitch.cgi", webRedirectToFallbackHTML)
 	mux.HandleFunc("/cgi-bin/mswitch.cgi", webRedirectToFallbackHTML)
 	mux.HandleFunc("/cgi-bin/fancylight.cgi", webRedirectToFallbackHTML)
 	mux.HandleFunc("/cgi-bin/ledpipe.cgi", webRedirectToFallbackHTML)
-	n.UseHandler(mux)
-	if err := http.ListenAndServe(EnvironOrDefault("GOMQTTWEBFRONT_HTTP_INTERFACE", DEFAULT_GOMQTTWEBFRONT_HTTP_INTERFACE), n); err != nil {
+	limiter, err := NewIPRateLimiter(EnvironOrDefault("GOMQTTWEBFRONT_RATELIMIT", DEFAULT_GOMQTTWEBFRONT_RATELIMIT), EnvironOrDefault("GOMQTTWEBFRONT_CLIENTIPHEADER", ""))
+	if err != nil {
+		panic(fmt.Errorf("GOMQTTWEBFRONT_RATELIMIT: %s", err))
+	}
+	n.UseHandler(webLimitPerIP(mux, limiter)) //static files are served before, only what does work counts
+
+	listeners, err := webListenersFromEnviron()
+	if err != nil {
 		panic(err)
 	}
+	var hsts time.Duration
+	if hstsspec := EnvironOrDefault("GOMQTTWEBFRONT_HSTS", ""); len(hstsspec) > 0 {
+		if hsts, err = time.ParseDuration(hstsspec); err != nil {
+			panic(fmt.Errorf("GOMQTTWEBFRONT_HSTS: %s", err))
+		}
+	}
+	var certs *tlsCertReloader
+	servers := make([]*http.Server, len(listeners))
+	for idx, wl := range listeners {
+		switch wl.mode {
+		case webServePlain:
+			servers[idx] = &http.Server{Handler: n}
+		case webServeTLS:
+			if certs == nil {
+				if certs, err = newTLSCertReloader(EnvironOrDefault("GOMQTTWEBFRONT_TLSCERT", ""), EnvironOrDefault("GOMQTTWEBFRONT_TLSKEY", "")); err != nil {
+					panic(err)
+				}
+				go certs.goWatch(ctx)
+			}
+			servers[idx] = &http.Server{Handler: webWithHSTS(n, hsts), TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}}
+		case webServeRedirect:
+			servers[idx] = &http.Server{Handler: webRedirectToHTTPS(webHTTPSPort(listeners))}
+		}
+		LogMain_.Printf("goRunWebserver: serving %s on %s", []string{"http", "https", "redirect to https"}[wl.mode], wl.listener.Addr())
+	}
+
+	shutdown_done := make(chan struct{})
+	go func() {
+		defer close(shutdown_done)
+		<-ctx.Done()
+		deadline, cancel := context.WithTimeout(context.Background(), shutdown_timeout_)
+		defer cancel()
+		for _, srv := range servers {
+			if err := srv.Shutdown(deadline); err != nil {
+				LogWS_.Println("goRunWebserver: shutdown:", err)
+			}
+		}
+		//Shutdown does not wait for websockets, they are hijacked
+		ws_clients_.waitEmpty(deadline)
+	}()
+	serve_errs := make(chan error, len(servers))
+	for idx, srv := range servers {
+		go func(srv *http.Server, wl webListener) {
+			if wl.mode == webServeTLS {
+				serve_errs <- srv.ServeTLS(wl.listener, "", "")
+			} else {
+				serve_errs <- srv.Serve(wl.listener)
+			}
+		}(srv, listeners[idx])
+	}
+	for range servers {
+		if err := <-serve_errs; err != http.ErrServerClosed {
+			panic(err)
+		}
+	}
+	<-shutdown_done
+	<-forwarded
 }
@@ -0,0 +1,281 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ws_client_queue_len_    = 128              // distinct ctx pending before we give up and resync the client
+	ws_client_max_lag_      = 30 * time.Second // clients that have had something pending for longer get disconnected
+	ws_ctx_subscribe_       = "subscribe"
+	ws_ctx_unsubscribe_     = "unsubscribe"
+	ws_max_subscriptions_   = 64
+	ws_max_ctx_pattern_len_ = 128
+)
+
+var ws_clients_ = &wsClientList{clients: make(map[*wsClientQueue]bool, 10)}
+
+func newWSClientQueue(remote, role string) *wsClientQueue {
+	return &wsClientQueue{remote: remote, role: role, pending: make(map[string]wsQueuedFrame, ws_client_queue_len_), order: make([]string, 0, ws_client_queue_len_), notify: make(chan struct{}, 1)}
+}
+
+func (q *wsClientQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// never blocks. A newer frame for a ctx still pending replaces the older one
+func (q *wsClientQueue) push(ctx string, frame []byte) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.resync || !q.wantsLocked(ctx) {
+		return //client gets everything anyway, or doesn't want it
+	}
+	if pending, inmap := q.pending[ctx]; inmap {
+		q.pending[ctx] = wsQueuedFrame{frame: frame, since: pending.since}
+	} else if len(q.order) >= ws_client_queue_len_ {
+		LogWS_.Printf("wsClientQueue %s: queue full, client will be resynced", q.remote)
+		q.clearLocked()
+		q.resync = true
+	} else {
+		q.pending[ctx] = wsQueuedFrame{frame: frame, since: time.Now()}
+		q.order = append(q.order, ctx)
+	}
+	q.wakeup()
+}
+
+// the client missed messages, e.g. because we missed them ourselves
+func (q *wsClientQueue) requestResync() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.clearLocked()
+	q.resync = true
+	q.wakeup()
+}
+
+func (q *wsClientQueue) clearLocked() {
+	q.pending = make(map[string]wsQueuedFrame, ws_client_queue_len_)
+	q.order = q.order[:0]
+}
+
+// takes everything pending, in order. Tells if the client needs a resync first and how long the oldest frame waited
+func (q *wsClientQueue) popAll() (frames [][]byte, resync bool, lag time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	resync = q.resync
+	q.resync = false
+	frames = make([][]byte, 0, len(q.order))
+	for _, ctx := range q.order {
+		pending := q.pending[ctx]
+		if waited := time.Since(pending.since); waited > lag {
+			lag = waited
+		}
+		frames = append(frames, pending.frame)
+	}
+	q.clearLocked()
+	return
+}
+
+func (l *wsClientList) add(q *wsClientQueue) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.clients[q] = true
+}
+
+func (l *wsClientList) remove(q *wsClientQueue) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.clients, q)
+}
+
+// waits until all clients are gone, or ctx is done
+func (l *wsClientList) waitEmpty(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		l.mutex.RLock()
+		remaining := len(l.clients)
+		l.mutex.RUnlock()
+		if remaining == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			LogWS_.Printf("wsClientList: %d clients did not go away", remaining)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *wsClientList) broadcast(ctx string, frame []byte) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for q := range l.clients {
+		q.push(ctx, frame)
+	}
+}
+
+func (l *wsClientList) resyncAll() {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for q := range l.clients {
+		q.requestResync()
+	}
+}
+
+// ctx of a marshalled wsMessage
+func frameCtx(frame []byte) string {
+	var msg struct {
+		Ctx string `json:"ctx"`
+	}
+	json.Unmarshal(frame, &msg)
+	return msg.Ctx
+}
+
+// like MQTT subscriptions: + matches one level, # all remaining ones
+func ctxMatches(pattern, ctx string) bool {
+	plevels := strings.Split(pattern, "/")
+	clevels := strings.Split(ctx, "/")
+	for idx, plevel := range plevels {
+		if plevel == "#" {
+			return true
+		}
+		if idx >= len(clevels) || (plevel != "+" && plevel != clevels[idx]) {
+			return false
+		}
+	}
+	return len(plevels) == len(clevels)
+}
+
+// patterns of ?key=a&key=b or ?key=a,b. Empty means all
+func ctxPatternsFromQuery(r *http.Request, key string) ([]string, error) {
+	patterns := make([]interface{}, 0, 4)
+	for _, ctxs := range r.URL.Query()[key] {
+		for _, ctx := range strings.Split(ctxs, ",") {
+			if len(ctx) > 0 {
+				patterns = append(patterns, ctx)
+			}
+		}
+	}
+	return parseCtxPatterns(patterns)
+}
+
+// a pattern or list of patterns, as sent in data of a subscribe or unsubscribe message
+func parseCtxPatterns(data interface{}) ([]string, error) {
+	var list []interface{}
+	switch d := data.(type) {
+	case string:
+		list = []interface{}{d}
+	case []interface{}:
+		list = d
+	default:
+		return nil, fmt.Errorf("expected a ctx pattern or a list of them")
+	}
+	if len(list) > ws_max_subscriptions_ {
+		return nil, fmt.Errorf("at most %d patterns", ws_max_subscriptions_)
+	}
+	patterns := make([]string, 0, len(list))
+	for _, p := range list {
+		pattern, isstring := p.(string)
+		if !isstring || len(pattern) == 0 || len(pattern) > ws_max_ctx_pattern_len_ {
+			return nil, fmt.Errorf("invalid ctx pattern %v", p)
+		}
+		for idx, level := range strings.Split(pattern, "/") {
+			if (strings.ContainsAny(level, "+#") && len(level) > 1) || (level == "#" && idx != strings.Count(pattern, "/")) {
+				return nil, fmt.Errorf("invalid ctx pattern %s, + and # must be whole levels, # the last one", pattern)
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// what keeps a client working: the device list, who is online and replies to its commands. Sent whatever it subscribed to
+func isWSControlCtx(ctx string) bool {
+	return ctx == ws_ctx_devices_ || ctx == ws_ctx_availability_ || ctx == ws_ctx_reply_
+}
+
+func (q *wsClientQueue) wantsLocked(ctx string) bool {
+	if !Devices().MayRead(q.role, ctx) {
+		return false
+	}
+	if q.subscriptions == nil || isWSControlCtx(ctx) {
+		return true
+	}
+	for pattern := range q.subscriptions {
+		if ctxMatches(pattern, ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+// the frames the client is subscribed to and may read
+func (q *wsClientQueue) filterFrames(frames [][]byte) [][]byte {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	wanted := make([][]byte, 0, len(frames))
+	for _, frame := range frames {
+		if q.wantsLocked(frameCtx(frame)) {
+			wanted = append(wanted, frame)
+		}
+	}
+	return wanted
+}
+
+// the first subscription replaces the implicit everything
+func (q *wsClientQueue) subscribe(patterns []string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	added := 0
+	for _, pattern := range patterns {
+		if !q.subscriptions[pattern] {
+			added++
+		}
+	}
+	if len(q.subscriptions)+added > ws_max_subscriptions_ {
+		return fmt.Errorf("at most %d patterns", ws_max_subscriptions_)
+	}
+	if q.subscriptions == nil {
+		q.subscriptions = make(map[string]bool, len(patterns))
+	}
+	for _, pattern := range patterns {
+		q.subscriptions[pattern] = true
+	}
+	return nil
+}
+
+// only what was subscribed can be unsubscribed, the implicit everything can't have holes
+func (q *wsClientQueue) unsubscribe(patterns []string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.subscriptions == nil {
+		return fmt.Errorf("nothing subscribed yet, subscribe to what you want instead")
+	}
+	for _, pattern := range patterns {
+		delete(q.subscriptions, pattern)
+	}
+	return nil
+}
+
+// the last known states of ctx matching patterns, e.g. for a client that just subscribed to them
+func (q *wsClientQueue) pushMatching(frames [][]byte, patterns []string) {
+	for _, frame := range frames {
+		ctx := frameCtx(frame)
+		for _, pattern := range patterns {
+			if ctxMatches(pattern, ctx) {
+				q.push(ctx, frame)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// (c) Bernhard Tittelbach, 2019
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestCtxMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, ctx string
+		want         bool
+	}{
+		{"action/ceiling1/light", "action/ceiling1/light", true},
+		{"action/ceiling1/light", "action/ceiling2/light", false},
+		{"action/+/light", "action/ceiling1/light", true},
+		{"action/+/light", "action/ceiling1/POWER", false},
+		{"action/+", "action/ceiling1/light", false},
+		{"action/+/+", "action/ceiling1", false},
+		{"action/#", "action/ceiling1/light", true},
+		{"action/#", "action", true},
+		{"action/#", "realraum/ceiling1", false},
+		{"#", "availability", true},
+		{"+", "availability", true},
+		{"+", "action/ceiling1", false},
+		{"availability", "availability/ceiling1", false},
+		{"action/ceiling1/light/extra", "action/ceiling1/light", false},
+	} {
+		if got := ctxMatches(tc.pattern, tc.ctx); got != tc.want {
+			t.Errorf("ctxMatches(%q, %q) = %v, want %v", tc.pattern, tc.ctx, got, tc.want)
+		}
+	}
+}
+
+func TestParseCtxPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		data interface{}
+		ok   bool
+	}{
+		{"action/+/light", true},
+		{[]interface{}{"action/#", "availability"}, true},
+		{"action/ceil+/light", false},
+		{"action/#/light", false},
+		{"", false},
+		{[]interface{}{"action/#", 1}, false},
+		{42.0, false},
+	} {
+		if _, err := parseCtxPatterns(tc.data); (err == nil) != tc.ok {
+			t.Errorf("parseCtxPatterns(%v): err %v, want ok %v", tc.data, err, tc.ok)
+		}
+	}
+}
+
+func TestWSClientSubscriptions(t *testing.T) {
+	q := newWSClientQueue("test", RoleMember)
+	if !q.wantsLocked("action/ceiling1/light") {
+		t.Error("without subscribe a client must get everything")
+	}
+	if err := q.unsubscribe([]string{"action/#"}); err == nil {
+		t.Error("unsubscribe before subscribe must be rejected")
+	}
+	if !q.wantsLocked("action/ceiling1/light") {
+		t.Error("a rejected unsubscribe must not change what the client gets")
+	}
+	if err := q.subscribe([]string{"action/+/light", "action/yamahastereo/+"}); err != nil {
+		t.Fatal(err)
+	}
+	for ctx, want := range map[string]bool{"action/ceiling1/light": true, "action/yamahastereo/ircmd": true, "action/couchred/POWER": false} {
+		if got := q.wantsLocked(ctx); got != want {
+			t.Errorf("after subscribe, wants %s = %v, want %v", ctx, got, want)
+		}
+	}
+	if err := q.unsubscribe([]string{"action/+/light"}); err != nil {
+		t.Fatal(err)
+	}
+	if q.wantsLocked("action/ceiling1/light") || !q.wantsLocked("action/yamahastereo/ircmd") {
+		t.Error("unsubscribe removed the wrong patterns")
+	}
+	//subscribed or not, clients need the device list, who is online and their replies
+	for _, ctx := range []string{ws_ctx_devices_, ws_ctx_availability_, ws_ctx_reply_} {
+		if !q.wantsLocked(ctx) {
+			t.Errorf("subscribed client does not get %s", ctx)
+		}
+	}
+	devices, _ := json.Marshal(wsMessage{Ctx: ws_ctx_devices_, Data: []string{}})
+	ceiling, _ := json.Marshal(wsMessage{Ctx: "action/ceiling1/light", Data: map[string]int{"r": 1}})
+	if got := q.filterFrames([][]byte{devices, ceiling}); len(got) != 1 || string(got[0]) != string(devices) {
+		t.Errorf("resync frames filtered to %q, want only the device list", got)
+	}
+	too_many := make([]string, ws_max_subscriptions_)
+	for idx := range too_many {
+		too_many[idx] = "action/" + string(rune('a'+idx%26)) + string(rune('a'+idx/26))
+	}
+	if err := q.subscribe(too_many); err == nil {
+		t.Errorf("subscribing to more than %d patterns must be rejected", ws_max_subscriptions_)
+	}
+}
+
+func TestWSClientReadsByRole(t *testing.T) {
+	reg, err := NewDeviceRegistry([]DeviceConfig{
+		{Name: "ceiling1", Kind: DeviceFancy, Topic: "action/ceiling1/light", Guest: true},
+		{Name: "olgaboiler", Kind: DeviceSonoff, Topic: "action/olgaboiler/POWER"},
+		{Name: "scenes", Kind: DeviceOther, StateTopic: "realraum/GoLightCtrl/scenes"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	olddevices := Devices()
+	setDevices(reg)
+	defer setDevices(olddevices)
+
+	frames := make([][]byte, 0, 4)
+	for _, ctx := range []string{"action/ceiling1/light", "action/olgaboiler/POWER", "realraum/GoLightCtrl/scenes", "availability"} {
+		frames = append(frames, []byte(fmt.Sprintf(`{"ctx":%q,"data":1}`, ctx)))
+	}
+	for role, want := range map[string]int{RoleMember: 4, RoleGuest: 3, RoleNone: 3} {
+		q := newWSClientQueue("test", role)
+		got := q.filterFrames(frames)
+		if len(got) != want {
+			t.Errorf("%s gets %d of %d frames, want %d", role, len(got), len(frames), want)
+		}
+		q.push("action/olgaboiler/POWER", frames[1])
+		if _, pending := q.pending["action/olgaboiler/POWER"]; pending != (role == RoleMember) {
+			t.Errorf("%s gets boiler updates: %v", role, pending)
+		}
+	}
+}